@@ -0,0 +1,216 @@
+// Command mr runs the jobs of the asg2/mapreduce/jobs registry.
+//
+//	mr run -job wordcount -input papers                  run a job in this process
+//	mr master -job wordcount -input papers -addr ADDR    run a job on workers
+//	mr worker -job wordcount -master ADDR -addr ADDR     serve a master's tasks
+//	mr status -master ADDR                               show a master's workers and jobs
+//	mr cancel -master ADDR -name NAME                    cancel a job
+//
+// Arguments after the flags are passed to the job, such as the pattern of a
+// grep job. Workers must be given the same -job, -name and job arguments as
+// their master. Addresses are unix socket paths, or host:port with
+// -transport tcp; URLs such as tcp://host:port are taken as they are.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+
+	"asg2/mapreduce"
+	"asg2/mapreduce/jobs"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "run", "master":
+		err = runJob(os.Args[1], os.Args[2:])
+	case "worker":
+		err = runWorker(os.Args[2:])
+	case "status":
+		err = status(os.Args[2:])
+	case "cancel":
+		err = cancel(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mr %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: mr run|master|worker|status|cancel [flags] [job arguments]\n")
+	fmt.Fprintf(os.Stderr, "jobs: %s\n", strings.Join(jobs.Names(), ", "))
+	os.Exit(2)
+}
+
+// jobFlags are the flags that pick a job and its settings.
+type jobFlags struct {
+	job      string
+	settings jobs.Settings
+}
+
+func (f *jobFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.job, "job", "", "the registered job to run: "+strings.Join(jobs.Names(), ", "))
+	fs.StringVar(&f.settings.Name, "name", "", "the name of the job's run (default the job)")
+	fs.StringVar(&f.settings.InputDir, "input", "", "the directory of the input files")
+	fs.StringVar(&f.settings.OutputDir, "output", "", "where to write the merged output (default the current directory)")
+	fs.IntVar(&f.settings.NReduce, "nreduce", 0, "the number of reduce tasks (default the job's)")
+}
+
+// build builds the chosen job, with the arguments left after the flags.
+func (f *jobFlags) build(fs *flag.FlagSet) (jobs.Runnable, error) {
+	if f.job == "" {
+		return nil, fmt.Errorf("no -job given")
+	}
+	if f.settings.Name == "" {
+		f.settings.Name = f.job
+	}
+	f.settings.Args = fs.Args()
+	return jobs.New(f.job, f.settings)
+}
+
+// address turns an address given on the command line into one for the given
+// transport.
+func address(transport string, addr string) (string, error) {
+	if strings.Contains(addr, "://") {
+		return addr, nil
+	}
+	switch transport {
+	case "unix":
+		return addr, nil
+	case "tcp":
+		return "tcp://" + addr, nil
+	}
+	return "", fmt.Errorf("unknown transport %q", transport)
+}
+
+// runJob runs a job in this process, or on workers as its master. An
+// interrupt cancels the job.
+func runJob(command string, args []string) error {
+	fs := flag.NewFlagSet("mr "+command, flag.ExitOnError)
+	var f jobFlags
+	f.register(fs)
+	var addr, transport string
+	if command == "master" {
+		fs.StringVar(&addr, "addr", "", "the address the master listens on")
+		fs.StringVar(&transport, "transport", "unix", "how workers reach the master: unix or tcp")
+	}
+	fs.Parse(args)
+	job, err := f.build(fs)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	var mr *mapreduce.Master
+	if command == "run" {
+		mr = job.Sequential(ctx)
+	} else {
+		if addr == "" {
+			return fmt.Errorf("no -addr given")
+		}
+		addr, err = address(transport, addr)
+		if err != nil {
+			return err
+		}
+		mr = job.Distributed(ctx, addr)
+	}
+	return mr.Wait()
+}
+
+// runWorker serves the tasks of a master until it shuts the worker down.
+func runWorker(args []string) error {
+	fs := flag.NewFlagSet("mr worker", flag.ExitOnError)
+	var f jobFlags
+	f.register(fs)
+	master := fs.String("master", "", "the address of the master")
+	addr := fs.String("addr", "", "the address the worker listens on, naming a host the master can reach")
+	transport := fs.String("transport", "unix", "how the master and the worker reach each other: unix or tcp")
+	slots := fs.Int("slots", runtime.NumCPU(), "how many tasks the worker runs at once")
+	local := fs.String("local", "", "comma-separated input directories the worker reads locally")
+	fs.Parse(args)
+	job, err := f.build(fs)
+	if err != nil {
+		return err
+	}
+	if *master == "" || *addr == "" {
+		return fmt.Errorf("both -master and -addr are needed")
+	}
+	masterAddr, err := address(*transport, *master)
+	if err != nil {
+		return err
+	}
+	me, err := address(*transport, *addr)
+	if err != nil {
+		return err
+	}
+	var localDirs []string
+	if *local != "" {
+		localDirs = strings.Split(*local, ",")
+	}
+	job.RunWorker(masterAddr, me, localDirs, *slots, -1, true)
+	return nil
+}
+
+// masterFlags parses the flags of the commands that talk to a running master.
+func masterFlags(name string, args []string, jobName *string) (string, error) {
+	fs := flag.NewFlagSet("mr "+name, flag.ExitOnError)
+	master := fs.String("master", "", "the address of the master")
+	transport := fs.String("transport", "unix", "how to reach the master: unix or tcp")
+	if jobName != nil {
+		fs.StringVar(jobName, "name", "", "the name of the job")
+	}
+	fs.Parse(args)
+	if *master == "" {
+		return "", fmt.Errorf("no -master given")
+	}
+	return address(*transport, *master)
+}
+
+// status prints the workers and jobs of a master.
+func status(args []string) error {
+	master, err := masterFlags("status", args, nil)
+	if err != nil {
+		return err
+	}
+	reply, err := mapreduce.RequestStatus(master)
+	if err != nil {
+		return err
+	}
+	for _, w := range reply.Workers {
+		fmt.Printf("worker %s: %v, %d slots, last heartbeat %s\n", w.Worker, w.State, w.Slots, w.LastHeartbeat.Format("15:04:05"))
+	}
+	for _, j := range reply.Jobs {
+		fmt.Printf("job %s: %s, %d/%d/%d tasks done/running/pending", j.JobName, j.Phase, j.TasksDone, j.TasksRunning, j.TasksPending)
+		if j.Err != "" {
+			fmt.Printf(", %s", j.Err)
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+// cancel cancels a job of a master.
+func cancel(args []string) error {
+	var jobName string
+	master, err := masterFlags("cancel", args, &jobName)
+	if err != nil {
+		return err
+	}
+	if jobName == "" {
+		return fmt.Errorf("no -name given")
+	}
+	return mapreduce.RequestCancel(master, jobName)
+}
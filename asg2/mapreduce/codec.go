@@ -0,0 +1,238 @@
+package mapreduce
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Codec defines how the key/value records of intermediate and reducer output
+// files are laid out on disk. Jobs select a codec by name in JobOptions.Codec.
+type Codec interface {
+	NewEncoder(w io.Writer) RecordEncoder
+	NewDecoder(r io.Reader) RecordDecoder
+}
+
+// RecordEncoder writes records one after the other.
+type RecordEncoder interface {
+	Encode(kv KeyValue) error
+}
+
+// RecordDecoder reads the records written by the matching RecordEncoder. It
+// returns io.EOF once there are no records left.
+type RecordDecoder interface {
+	Decode(kv *KeyValue) error
+}
+
+// codecsLock protects codecs, which jobs may register into while the tasks of
+// other jobs read it.
+var codecsLock sync.RWMutex
+
+// The codecs and compression formats jobs may choose from, by name. The empty
+// name selects the default.
+var (
+	codecs = map[string]Codec{
+		"":       jsonCodec{},
+		"json":   jsonCodec{},
+		"gob":    gobCodec{},
+		"binary": binaryCodec{},
+	}
+	compressions = map[string]bool{
+		"":      true, // no compression
+		"gzip":  true,
+		"flate": true, // raw DEFLATE at its fastest level, trading ratio for speed
+	}
+)
+
+// RegisterCodec makes a custom codec available to jobs under the given name.
+// It must be registered under the same name on the master and every worker.
+func RegisterCodec(name string, codec Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	codecs[name] = codec
+}
+
+// codec returns the codec registered under the given name.
+func codec(name string) (Codec, bool) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// checkEncoding verifies that the codec and compression chosen by a job exist.
+func checkEncoding(options JobOptions) error {
+	if _, ok := codec(options.Codec); !ok {
+		return fmt.Errorf("unknown codec %q", options.Codec)
+	}
+	if !compressions[options.Compression] {
+		return fmt.Errorf("unknown compression %q", options.Compression)
+	}
+	return nil
+}
+
+// recordWriter encodes records into a file with the codec and compression of
+// a job. Close must be called to flush them; it does not close the file.
+type recordWriter struct {
+	RecordEncoder
+	buf        *bufio.Writer
+	compressor io.WriteCloser // nil when the job is not compressed
+}
+
+func newRecordWriter(w io.Writer, options JobOptions) (*recordWriter, error) {
+	err := checkEncoding(options)
+	if err != nil {
+		return nil, err
+	}
+	rw := &recordWriter{buf: bufio.NewWriter(w)}
+	var out io.Writer = rw.buf
+	switch options.Compression {
+	case "gzip":
+		rw.compressor = gzip.NewWriter(rw.buf)
+		out = rw.compressor
+	case "flate":
+		rw.compressor, _ = flate.NewWriter(rw.buf, flate.BestSpeed)
+		out = rw.compressor
+	}
+	c, _ := codec(options.Codec)
+	rw.RecordEncoder = c.NewEncoder(out)
+	return rw, nil
+}
+
+func (rw *recordWriter) Close() error {
+	if rw.compressor != nil {
+		err := rw.compressor.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return rw.buf.Flush()
+}
+
+// newRecordReader decodes the records of a file written by a recordWriter with
+// the same options.
+func newRecordReader(r io.Reader, options JobOptions) (RecordDecoder, error) {
+	err := checkEncoding(options)
+	if err != nil {
+		return nil, err
+	}
+	var in io.Reader = bufio.NewReader(r)
+	switch options.Compression {
+	case "gzip":
+		in, err = gzip.NewReader(in)
+		if err != nil {
+			return nil, err
+		}
+	case "flate":
+		in = flate.NewReader(in)
+	}
+	c, _ := codec(options.Codec)
+	return c.NewDecoder(in), nil
+}
+
+// jsonCodec writes one JSON object per record.
+type jsonCodec struct{}
+
+type jsonEncoder struct{ *json.Encoder }
+type jsonDecoder struct{ *json.Decoder }
+
+func (jsonCodec) NewEncoder(w io.Writer) RecordEncoder { return jsonEncoder{json.NewEncoder(w)} }
+func (jsonCodec) NewDecoder(r io.Reader) RecordDecoder { return jsonDecoder{json.NewDecoder(r)} }
+
+func (e jsonEncoder) Encode(kv KeyValue) error  { return e.Encoder.Encode(kv) }
+func (d jsonDecoder) Decode(kv *KeyValue) error { return d.Decoder.Decode(kv) }
+
+// gobCodec writes the records as a gob stream.
+type gobCodec struct{}
+
+type gobEncoder struct{ *gob.Encoder }
+type gobDecoder struct{ *gob.Decoder }
+
+func (gobCodec) NewEncoder(w io.Writer) RecordEncoder { return gobEncoder{gob.NewEncoder(w)} }
+func (gobCodec) NewDecoder(r io.Reader) RecordDecoder { return gobDecoder{gob.NewDecoder(r)} }
+
+func (e gobEncoder) Encode(kv KeyValue) error { return e.Encoder.Encode(kv) }
+
+// Decode resets kv first, since gob leaves the fields that were encoded with
+// their zero value untouched.
+func (d gobDecoder) Decode(kv *KeyValue) error {
+	*kv = KeyValue{}
+	return d.Decoder.Decode(kv)
+}
+
+// binaryCodec writes each record as the uvarint-prefixed bytes of its key
+// followed by the uvarint-prefixed bytes of its value.
+type binaryCodec struct{}
+
+// maxBinaryField bounds the length of a key or value the binary codec decodes,
+// as gob bounds the length of its messages, so that a corrupt length fails the
+// task reading it instead of allocating that much memory.
+const maxBinaryField = 1 << 30
+
+type binaryEncoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+type binaryDecoder struct {
+	r *bufio.Reader
+}
+
+func (binaryCodec) NewEncoder(w io.Writer) RecordEncoder { return &binaryEncoder{w: w} }
+
+func (binaryCodec) NewDecoder(r io.Reader) RecordDecoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &binaryDecoder{r: br}
+}
+
+func (e *binaryEncoder) Encode(kv KeyValue) error {
+	e.buf = e.buf[:0]
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(kv.Key)))
+	e.buf = append(e.buf, kv.Key...)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(kv.Value)))
+	e.buf = append(e.buf, kv.Value...)
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+func (d *binaryDecoder) Decode(kv *KeyValue) error {
+	key, err := d.readString()
+	if err != nil {
+		return err // io.EOF at a record boundary ends the stream
+	}
+	value, err := d.readString()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	kv.Key, kv.Value = key, value
+	return nil
+}
+
+func (d *binaryDecoder) readString() (string, error) {
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return "", err
+	}
+	if n > maxBinaryField {
+		return "", fmt.Errorf("binary codec: %d-byte field exceeds %d bytes", n, maxBinaryField)
+	}
+	// The buffer grows as the bytes arrive, so that a length that a
+	// truncated file does not live up to is never allocated in full.
+	b, err := io.ReadAll(io.LimitReader(d.r, int64(n)))
+	if err == nil && uint64(len(b)) < n {
+		err = io.ErrUnexpectedEOF
+	}
+	return string(b), err
+}
@@ -0,0 +1,118 @@
+package mapreduce
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Every attempt at a task writes its output files under attempt-specific names
+// (see getAttemptName), so that a crashed attempt cannot leave a truncated file
+// behind and duplicate attempts cannot overwrite each other's files. Once an
+// attempt succeeds, the master picks it as the authoritative one and commits
+// its output by renaming the files to their final names; the output of every
+// other attempt at the task is discarded.
+//
+// A job that shuffles map output between workers (see JobOptions.LocalShuffle)
+// leaves the map output on the worker that wrote it, under the attempt's names.
+// Committing a map task only records which worker and attempt reducers fetch
+// its output from. The workers of the other attempts are told to remove their
+// output, and every worker drops what it kept for the job once the job has
+// completed or been cancelled.
+
+// taskOutputs lists the final names of the files produced by a task in the
+// job's work directory.
+func (j *job) taskOutputs(phase jobPhase, task int) []string {
+	switch {
+	case phase == mapPhase && j.config.Options.LocalShuffle:
+		return nil
+	case phase == mapPhase:
+		names := make([]string, 0, j.config.NReduce)
+		for i := 0; i < j.config.NReduce; i++ {
+			names = append(names, getIntermediateName(j.config.WorkDir, j.jobName, task, i))
+		}
+		return names
+	default:
+		return []string{getReduceOutName(j.config.WorkDir, j.jobName, task)}
+	}
+}
+
+// commitTask atomically publishes the output of an attempt at a task and
+// records in the journal which attempt, run by which worker, it came from.
+func (j *job) commitTask(phase jobPhase, task int, attempt int, worker string) error {
+	for _, name := range j.taskOutputs(phase, task) {
+		err := os.Rename(getAttemptName(name, attempt), name)
+		if err != nil {
+			return err
+		}
+	}
+	if phase != mapPhase || !j.config.Options.LocalShuffle {
+		worker = ""
+	}
+	return j.journal.commit(phase, task, attempt, worker)
+}
+
+// discardAttempt removes whatever output an attempt at a task has written.
+func (j *job) discardAttempt(phase jobPhase, task int, attempt int) {
+	for _, name := range j.taskOutputs(phase, task) {
+		os.Remove(getAttemptName(name, attempt))
+	}
+}
+
+// discardAttempt removes whatever output an attempt at a task has written,
+// including the map output its worker kept if the job shuffles it between
+// workers. The worker is not waited for.
+func (mr *Master) discardAttempt(j *job, phase jobPhase, a *taskAttempt) {
+	j.discardAttempt(phase, a.task, a.attempt)
+	if phase == mapPhase && j.config.Options.LocalShuffle {
+		args := &DiscardArgs{JobName: j.jobName, MapTask: a.task, Attempt: a.attempt, NReduce: j.config.NReduce}
+		go mr.clients.call(a.worker, "Worker.DiscardAttempt", args, new(struct{}))
+	}
+}
+
+// dropMapOutputs tells the live workers to remove the map output they kept
+// for a job that shuffles it between workers, and waits for them to reply.
+func (mr *Master) dropMapOutputs(j *job) {
+	mr.Lock()
+	var workers []string
+	for _, w := range mr.workers {
+		if mr.stateLocked(w) != WorkerDead {
+			workers = append(workers, w)
+		}
+	}
+	mr.Unlock()
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(worker string) {
+			defer wg.Done()
+			mr.clients.call(worker, "Worker.DropJob", &JobArgs{JobName: j.jobName}, new(struct{}))
+		}(w)
+	}
+	wg.Wait()
+}
+
+// loseMapOutput retracts the commit of a map task whose output can no longer
+// be fetched, so that the task is run again. A map task whose output keeps
+// getting lost fails the job.
+func (j *job) loseMapOutput(task int) error {
+	j.lostOutputs[task]++
+	if j.lostOutputs[task] > maxTaskFailures {
+		return fmt.Errorf("output of map task %d lost %d times", task, j.lostOutputs[task])
+	}
+	return j.journal.retract(mapPhase, task)
+}
+
+// mapOutputs tells reducers where to fetch the committed output of every map
+// task from, for a job that shuffles map output between workers.
+func (j *job) mapOutputs() []MapOutput {
+	if !j.config.Options.LocalShuffle {
+		return nil
+	}
+	outputs := make([]MapOutput, len(j.splits))
+	for i := range j.splits {
+		e := j.journal.committed[taskID{mapPhase, i}]
+		outputs[i] = MapOutput{Worker: e.Worker, Attempt: e.Attempt}
+	}
+	return outputs
+}
@@ -9,7 +9,13 @@ import (
 )
 
 const debugEnabled = true
-const outTestPath = "tmp_testout552"
+
+// Where jobs keep their intermediate files and put their merged output when
+// their JobConfig does not say.
+const (
+	defaultWorkDir   = "tmp_testout552"
+	defaultOutputDir = "."
+)
 
 // The function will only print if the debugEnabled const has been set to true
 func debug(format string, a ...interface{}) (n int, err error) {
@@ -40,26 +46,113 @@ type KeyValue struct {
 	Value string
 }
 
+// JobOptions holds the optional settings of a job. The master sends them to
+// the workers with every task; the zero value selects the defaults.
+type JobOptions struct {
+	Combine     bool        // apply the workers' combiner to map output (Distributed only)
+	Partitioner Partitioner // routes map output to reduce tasks, nil means HashPartitioner
+	Codec       string      // record format of intermediate and reducer output files: "json" (default), "gob" or "binary"
+	Compression string      // compression of those files: "" (none), "gzip" or "flate"
+	Input       InputFormat // divides the input files among map tasks, nil means WholeFileInput
+	KeyOrder    string      // the key order registered with RegisterKeyOrder, "" sorts keys as strings
+	Grouping    string      // the key grouping registered with RegisterKeyGrouping, "" groups equal keys
+
+	// LocalShuffle keeps map output on the workers that wrote it, from which
+	// reduce tasks fetch it with the Worker.FetchPartition RPC, instead of in
+	// the shared work directory (Distributed only).
+	LocalShuffle bool
+}
+
+// JobConfig describes a job: where it reads its input, where it works and
+// where it writes its output. Each job keeps its intermediate files in a
+// directory of its own under WorkDir, so jobs with different names may share
+// a WorkDir and an OutputDir.
+type JobConfig struct {
+	InputDir  string    // directory of the input files
+	WorkDir   string    // parent of the job's intermediate files, tmp_testout552 if empty
+	OutputDir string    // where the merged output mrtmp.<job> is written, the current directory if empty
+	Retention Retention // which intermediate files are left once the job completes
+	NReduce   int       // number of reduce tasks
+	Options   JobOptions
+
+	// SkipBadRecords makes re-executions of a task skip a record once user
+	// functions have panicked on it, or rejected it, this many times; 0
+	// never skips.
+	SkipBadRecords int
+}
+
+// withDefaults fills in the directories left empty.
+func (c JobConfig) withDefaults() JobConfig {
+	if c.WorkDir == "" {
+		c.WorkDir = defaultWorkDir
+	}
+	if c.OutputDir == "" {
+		c.OutputDir = defaultOutputDir
+	}
+	return c
+}
+
+// Retention tells which of its files a job leaves behind once it completes.
+type Retention int
+
+const (
+	KeepAll          Retention = iota // keep the map and reducer outputs (the default)
+	KeepReduceOutput                  // remove the map outputs
+	KeepMergedOutput                  // only keep the merged output
+)
+
+// ValueIterator hands a reduce (or combine) function the values of a key one
+// at a time, so that a key may have more values than fit in memory.
+type ValueIterator interface {
+	// Next returns the next value, or ok == false once all have been read.
+	Next() (value string, ok bool)
+	Reporter // adds to the counters of the job
+}
+
+// getJobDir constructs the name of the directory holding the intermediate
+// files of job <jobName>, so that jobs running side by side do not collide
+func getJobDir(workDir string, jobName string) string {
+	return filepath.Join(workDir, jobName)
+}
+
 // getIntermediateName constructs the name of the intermediate file which map task
 // <mapTask> produces for reduce task <reduceTask>.
-func getIntermediateName(jobName string, mapTask int, reduceTask int) string {
-	return filepath.Join(outTestPath, "mrtmp."+jobName+"-"+strconv.Itoa(mapTask)+"-"+strconv.Itoa(reduceTask))
+func getIntermediateName(workDir string, jobName string, mapTask int, reduceTask int) string {
+	return filepath.Join(getJobDir(workDir, jobName), "mrtmp."+jobName+"-"+strconv.Itoa(mapTask)+"-"+strconv.Itoa(reduceTask))
 }
 
 // getReduceOutName constructs the name of the output file of reduce task <reduceTask>
-func getReduceOutName(jobName string, reduceTask int) string {
-	return filepath.Join(outTestPath, "mrtmp."+jobName+"-res-"+strconv.Itoa(reduceTask))
+func getReduceOutName(workDir string, jobName string, reduceTask int) string {
+	return filepath.Join(getJobDir(workDir, jobName), "mrtmp."+jobName+"-res-"+strconv.Itoa(reduceTask))
 }
 
-func getChildrenFiles(parentDir string) []string {
+// getAttemptName constructs the name under which attempt <attempt> of a task
+// writes the output file <fileName>, until the master commits it.
+func getAttemptName(fileName string, attempt int) string {
+	return fileName + ".attempt" + strconv.Itoa(attempt)
+}
+
+// getJournalName constructs the name of the file in which the master records
+// the committed tasks of job <jobName>
+func getJournalName(workDir string, jobName string) string {
+	return filepath.Join(getJobDir(workDir, jobName), "mrtmp."+jobName+"-journal")
+}
+
+// getMergeName constructs the name of the file into which the master merges
+// the reducer outputs of job <jobName>
+func getMergeName(outputDir string, jobName string) string {
+	return filepath.Join(outputDir, "mrtmp."+jobName)
+}
+
+func getChildrenFiles(parentDir string) ([]string, error) {
 	files := make([]string, 0)
 	entries, err := os.ReadDir(parentDir)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	for _, e := range entries {
 		files = append(files, filepath.Join(parentDir, e.Name()))
 	}
-	return files
+	return files, nil
 }
@@ -1,8 +1,14 @@
 package mapreduce
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/rpc"
+	"net/url"
+	"os"
+	"sync"
+	"time"
 )
 
 // What follows are RPC types and methods.
@@ -12,25 +18,135 @@ import (
 // scheduled on it.
 type RunTaskArgs struct {
 	JobName    string
-	File       string   // input file, only used in map tasks
-	Phase      jobPhase // are we in mapPhase or reducePhase?
-	TaskNumber int      // this task's index in the current phase
+	WorkDir    string      // where the job's intermediate files live
+	Split      InputSplit  // input ranges, only used in map tasks
+	Phase      jobPhase    // are we in mapPhase or reducePhase?
+	TaskNumber int         // this task's index in the current phase
+	Attempt    int         // distinguishes the outputs of repeated executions of a task
+	Skip       []BadRecord // records that user functions failed on too often
 
 	// NumOtherPhase is the total number of tasks in other phase; mappers
 	// need this to compute the number of output bins, and reducers needs
 	// this to know how many input files to collect.
 	NumOtherPhase int
+
+	Options JobOptions // the job's combiner, partitioner and file encoding settings
+
+	// MapOutputs tells a reduce task where the output of each map task is,
+	// if the job shuffles map output between workers.
+	MapOutputs []MapOutput
+}
+
+// MapOutput locates the committed output of a map task that its worker kept.
+type MapOutput struct {
+	Worker  string
+	Attempt int
+}
+
+// RunTaskReply is the response to a Worker.RunTask RPC. Err is set if the task
+// failed, and Stats measures the work the attempt did.
+type RunTaskReply struct {
+	Err   *TaskError
+	Stats TaskStats
+}
+
+// FetchArgs asks a worker for part of the output that an attempt at a map
+// task wrote for a reduce task, starting at Offset.
+type FetchArgs struct {
+	JobName    string
+	MapTask    int
+	ReduceTask int
+	Attempt    int
+	Offset     int64
+}
+
+// FetchReply is the response to a Worker.FetchPartition RPC. It holds at most
+// fetchChunkSize bytes of the partition, whose total size is Size.
+type FetchReply struct {
+	Data []byte
+	Size int64
+}
+
+// AttemptArgs names an attempt at a task, for the Worker.AbandonAttempt RPC.
+type AttemptArgs struct {
+	JobName string
+	Phase   jobPhase
+	Task    int
+	Attempt int
+}
+
+// DiscardArgs names an attempt at a map task whose output a worker kept, for
+// the Worker.DiscardAttempt RPC. The attempt wrote one file per reduce task.
+type DiscardArgs struct {
+	JobName string
+	MapTask int
+	Attempt int
+	NReduce int
 }
 
 // ShutdownReply is the response to a WorkerShutdown.
-// It holds the number of tasks this worker has processed since it was started.
+// It holds the number of tasks this worker has run since it was started, and
+// what each of its slots did.
 type ShutdownReply struct {
 	Ntasks int
+	Slots  []SlotStats
+}
+
+// SlotStats describes the tasks that one slot of a worker has run.
+type SlotStats struct {
+	Tasks int
+	Busy  time.Duration // time spent running them
 }
 
 // RegisterArgs is the argument passed when a worker registers with the master.
+// Local lists the directories or hosts whose input files the worker reads
+// locally, which the master prefers to give it map tasks over. Slots is the
+// number of tasks the worker runs at once.
 type RegisterArgs struct {
 	Worker string
+	Local  []string
+	Slots  int
+}
+
+// HeartbeatArgs is sent periodically by a worker to show it is alive. It
+// carries the progress of the attempts the worker is running.
+type HeartbeatArgs struct {
+	Worker string
+	Tasks  []TaskProgress
+}
+
+// HeartbeatReply tells a worker whether the master counts it as registered. A
+// worker that is not, because it is unknown or was declared dead, registers
+// again.
+type HeartbeatReply struct {
+	Registered bool
+}
+
+// WorkerStatus describes a registered worker as the master sees it.
+type WorkerStatus struct {
+	Worker        string
+	State         WorkerState
+	LastHeartbeat time.Time
+	Local         []string // directories or hosts the worker reads locally
+	Slots         int      // tasks the worker runs at once
+}
+
+// StatusReply is the response to a Master.Status RPC.
+type StatusReply struct {
+	Workers []WorkerStatus
+	Jobs    []JobStatus
+}
+
+// SubmitArgs is the argument passed when a client submits a job to a
+// long-lived master with the Master.Submit RPC.
+type SubmitArgs struct {
+	JobName string
+	Config  JobConfig
+}
+
+// JobArgs names the job an RPC such as Master.WaitForJob refers to.
+type JobArgs struct {
+	JobName string
 }
 
 // call() sends an RPC to the rpcname handler on server srv
@@ -44,10 +160,10 @@ type RegisterArgs struct {
 //
 // you should assume that call() will time out and return an
 // error (false) after a while if it doesn't get a reply from the server.
-//
 func call(srv string, rpcname string,
 	args interface{}, reply interface{}) bool {
-	c, errx := rpc.Dial("unix", srv)
+	network, address := parseAddress(srv)
+	c, errx := rpc.Dial(network, address)
 	if errx != nil {
 		return false
 	}
@@ -61,3 +177,190 @@ func call(srv string, rpcname string,
 	fmt.Println(err)
 	return false
 }
+
+// rpcClients keeps a connection open to every server it has called, so that
+// the master and a worker exchange all their RPCs over one connection instead
+// of dialing for each. A connection that breaks is dropped, and the next call
+// to the server dials a new one. A nil *rpcClients dials for every call, as
+// call does.
+type rpcClients struct {
+	sync.Mutex
+	conns  map[string]*rpc.Client
+	closed bool
+}
+
+func newRPCClients() *rpcClients {
+	return &rpcClients{conns: make(map[string]*rpc.Client)}
+}
+
+// call is like the call function, over the connection to srv. A call that
+// finds the connection already broken is sent again over a new one; a call
+// that was sent when the connection broke fails, since the server may have
+// acted on it.
+func (rc *rpcClients) call(srv string, rpcname string, args interface{}, reply interface{}) bool {
+	return rc.callContext(context.Background(), srv, rpcname, args, reply)
+}
+
+// callContext is like call, but stops waiting for the reply once ctx is done
+// and fails. The connection is kept for the other calls over it, and a reply
+// that comes later is thrown away. A nil *rpcClients waits for the reply.
+func (rc *rpcClients) callContext(ctx context.Context, srv string, rpcname string, args interface{}, reply interface{}) bool {
+	if rc == nil {
+		return call(srv, rpcname, args, reply)
+	}
+	c, err := rc.client(srv)
+	if err == nil {
+		err = callOver(ctx, c, rpcname, args, reply)
+		if err == rpc.ErrShutdown {
+			rc.drop(srv, c)
+			c, err = rc.client(srv)
+			if err == nil {
+				err = callOver(ctx, c, rpcname, args, reply)
+			}
+		}
+	}
+	if err == nil {
+		return true
+	}
+	if err == ctx.Err() {
+		return false
+	}
+	if _, ok := err.(rpc.ServerError); !ok && c != nil {
+		rc.drop(srv, c)
+	}
+	fmt.Println(err)
+	return false
+}
+
+// callOver sends an RPC over c and waits for its reply, or for ctx to be done.
+func callOver(ctx context.Context, c *rpc.Client, rpcname string, args interface{}, reply interface{}) error {
+	call := c.Go(rpcname, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// client returns the connection to srv, dialing it if there is none. Other
+// servers can be called while it dials.
+func (rc *rpcClients) client(srv string) (*rpc.Client, error) {
+	rc.Lock()
+	c, ok := rc.conns[srv]
+	closed := rc.closed
+	rc.Unlock()
+	if closed {
+		return nil, rpc.ErrShutdown
+	}
+	if ok {
+		return c, nil
+	}
+	network, address := parseAddress(srv)
+	c, err := rpc.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	rc.Lock()
+	defer rc.Unlock()
+	if other, ok := rc.conns[srv]; ok || rc.closed {
+		c.Close() // dialed at the same time as another call, or closed since
+		if !ok {
+			return nil, rpc.ErrShutdown
+		}
+		return other, nil
+	}
+	rc.conns[srv] = c
+	return c, nil
+}
+
+// drop closes a broken connection to srv, unless it has been replaced.
+func (rc *rpcClients) drop(srv string, c *rpc.Client) {
+	rc.Lock()
+	defer rc.Unlock()
+	if rc.conns[srv] == c {
+		delete(rc.conns, srv)
+	}
+	c.Close()
+}
+
+// close closes all the connections; later calls fail.
+func (rc *rpcClients) close() {
+	rc.Lock()
+	defer rc.Unlock()
+	rc.closed = true
+	for srv, c := range rc.conns {
+		c.Close()
+		delete(rc.conns, srv)
+	}
+}
+
+// invoke is like call, but returns the error that kept the RPC from
+// succeeding, for clients that report it.
+func invoke(srv string, rpcname string, args interface{}, reply interface{}) error {
+	network, address := parseAddress(srv)
+	c, err := rpc.Dial(network, address)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.Call(rpcname, args, reply)
+}
+
+// parseAddress splits the address of a master or worker into the network and
+// address expected by net.Dial and net.Listen. Addresses are URLs such as
+// unix:///var/tmp/mr-master or tcp://host:port; an address without one of
+// those schemes is taken to be the path of a unix socket.
+func parseAddress(addr string) (network string, address string) {
+	u, err := url.Parse(addr)
+	if err == nil {
+		switch u.Scheme {
+		case "unix":
+			return "unix", u.Host + u.Path
+		case "tcp":
+			return "tcp", u.Host
+		}
+	}
+	return "unix", addr
+}
+
+// listen announces on the given master or worker address. It also returns the
+// address others should use to reach the listener, which differs from addr
+// when a tcp address leaves the port (0) for the system to choose. The host is
+// kept as it was given: the one the listener is bound to may only be reachable
+// from the same machine.
+func listen(addr string) (net.Listener, string, error) {
+	network, address := parseAddress(addr)
+	if network == "unix" {
+		os.Remove(address)
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, "", err
+	}
+	if network == "tcp" {
+		host, _, _ := net.SplitHostPort(address)
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+		addr = "tcp://" + net.JoinHostPort(host, port)
+	}
+	return l, addr, nil
+}
+
+// checkWorkerAddress tells why the master could not reach a worker listening
+// on addr, if it could not. A worker sends its address to the master, so a tcp
+// address must name a host other machines can dial rather than listen on all
+// of them.
+func checkWorkerAddress(addr string) error {
+	network, address := parseAddress(addr)
+	if network != "tcp" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		return fmt.Errorf("worker address %s does not name a host the master can reach", addr)
+	}
+	return nil
+}
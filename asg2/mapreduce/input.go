@@ -0,0 +1,199 @@
+package mapreduce
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"os"
+)
+
+// FileRange is a contiguous byte range of an input file.
+type FileRange struct {
+	File   string
+	Offset int64
+	Length int64
+}
+
+// InputSplit is the input of a single map task. The map function is called
+// once for each of its ranges. Hosts optionally names the hosts that store the
+// input, for the scheduler to run the task on one of them; the directories of
+// the files are considered as well.
+type InputSplit struct {
+	Ranges []FileRange
+	Hosts  []string
+}
+
+// InputFormat divides the input files of a job into the splits processed by
+// its map tasks. The master computes the splits and sends each one with its
+// map task, so the workers only need to be able to read them.
+type InputFormat interface {
+	Splits(files []string) ([]InputSplit, error)
+}
+
+func init() {
+	gob.Register(WholeFileInput{})
+	gob.Register(TextInput{})
+	gob.Register(JobOutput{})
+}
+
+// WholeFileInput makes every input file a split of its own. It is the default
+// when a job does not specify an input format.
+type WholeFileInput struct{}
+
+func (WholeFileInput) Splits(files []string) ([]InputSplit, error) {
+	splits := make([]InputSplit, 0, len(files))
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		splits = append(splits, InputSplit{Ranges: []FileRange{{File: f, Length: info.Size()}}})
+	}
+	return splits, nil
+}
+
+// The split size TextInput uses when none is given.
+const defaultSplitSize = 64 << 20
+
+// TextInput cuts line-oriented input into splits of about SplitSize bytes that
+// never break a line. Files larger than SplitSize are spread over several map
+// tasks, while consecutive smaller files are packed into a combined split.
+type TextInput struct {
+	SplitSize int64
+}
+
+func (in TextInput) Splits(files []string) ([]InputSplit, error) {
+	size := in.SplitSize
+	if size <= 0 {
+		size = defaultSplitSize
+	}
+
+	var splits []InputSplit
+	var current InputSplit
+	var currentSize int64
+	for _, f := range files {
+		ranges, err := lineAlignedRanges(f, size)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range ranges {
+			if len(current.Ranges) > 0 && currentSize+r.Length > size {
+				splits = append(splits, current)
+				current, currentSize = InputSplit{}, 0
+			}
+			current.Ranges = append(current.Ranges, r)
+			currentSize += r.Length
+		}
+	}
+	if len(current.Ranges) > 0 {
+		splits = append(splits, current)
+	}
+	return splits, nil
+}
+
+// JobOutput reads the reducer output files of an earlier job, so that jobs can
+// be chained into a pipeline (see SequentialPipeline and DistributedPipeline). Every reducer output file
+// is a split of its own, and the map function is called once for each of its
+// records, with the record's key and value in place of a file name and its
+// contents. The fields must match the configuration of the earlier job.
+type JobOutput struct {
+	WorkDir     string
+	JobName     string
+	NReduce     int
+	Codec       string
+	Compression string
+}
+
+// Splits ignores the input files of the job reading the output.
+func (in JobOutput) Splits(files []string) ([]InputSplit, error) {
+	splits := make([]InputSplit, 0, in.NReduce)
+	for i := 0; i < in.NReduce; i++ {
+		f := getReduceOutName(in.WorkDir, in.JobName, i)
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		splits = append(splits, InputSplit{Ranges: []FileRange{{File: f, Length: info.Size()}}})
+	}
+	return splits, nil
+}
+
+// readRecords decodes the records of a reducer output file. Compressed files
+// cannot be read from the middle, so the range always covers the whole file.
+// The bytes read are counted in stats.
+func (in JobOutput) readRecords(r FileRange, stats *taskStats) ([]KeyValue, error) {
+	file, err := openInput(r.File)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	dec, err := newRecordReader(countingReader{file, stats}, JobOptions{Codec: in.Codec, Compression: in.Compression})
+	if err != nil {
+		return nil, err
+	}
+	var records []KeyValue
+	for {
+		var kv KeyValue
+		err = dec.Decode(&kv)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, kv)
+	}
+}
+
+// lineAlignedRanges cuts a file into ranges of at least size bytes, extending
+// each one up to the end of the line it would otherwise cut.
+func lineAlignedRanges(fileName string, size int64) ([]FileRange, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var ranges []FileRange
+	for offset := int64(0); offset < info.Size(); {
+		end := offset + size
+		if end < info.Size() {
+			rest := bufio.NewReader(io.NewSectionReader(file, end, info.Size()-end))
+			tail, err := rest.ReadString('\n')
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			end += int64(len(tail))
+		} else {
+			end = info.Size()
+		}
+		ranges = append(ranges, FileRange{File: fileName, Offset: offset, Length: end - offset})
+		offset = end
+	}
+	return ranges, nil
+}
+
+// getSplits divides the input files with the given format, or one split per
+// file if format is nil.
+func getSplits(files []string, format InputFormat) ([]InputSplit, error) {
+	if format == nil {
+		format = WholeFileInput{}
+	}
+	return format.Splits(files)
+}
+
+// readRange returns the contents of a range of an input file.
+func readRange(r FileRange) ([]byte, error) {
+	file, err := openInput(r.File)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	contents := make([]byte, r.Length)
+	_, err = io.ReadFull(io.NewSectionReader(file, r.Offset, r.Length), contents)
+	return contents, err
+}
@@ -0,0 +1,245 @@
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// job holds the state of one MapReduce job run by a Master. A long-lived
+// master runs several jobs at once, sharing its workers among them.
+type job struct {
+	jobName string       // Name of the job, unique among the master's jobs
+	files   []string     // Input files
+	splits  []InputSplit // Inputs of the map tasks
+	config  JobConfig
+	journal *journal                // Committed tasks, for resuming after a crash
+	done    chan struct{}           // Closed once the job's output has been merged
+	ctx     context.Context         // Done once the job is cancelled
+	stop    context.CancelCauseFunc // Cancels ctx, giving the reason
+	err     error                   // Why the job failed, set before done is closed
+
+	// Failures per record of each task, used by the job's scheduler only.
+	badRecords map[taskID]map[BadRecord]int
+
+	// Attempts started per task, which a phase that is run again carries
+	// on numbering, and times the output of each map task was lost. Used by
+	// the job's scheduler only.
+	attempts    map[taskID]int
+	lostOutputs map[int]int
+
+	// Protected by the master's mutex, and used to share workers fairly
+	// between jobs.
+	running      int  // Attempts in flight
+	wantsWorkers bool // Whether the job has work for another worker
+
+	status JobStatus // Progress reported by Status, protected by the master's mutex
+}
+
+// newJob prepares a job over the files in config.InputDir. A job whose input
+// format does not read input files, such as JobOutput, may leave it empty. The
+// job is cancelled along with ctx.
+func newJob(ctx context.Context, jobName string, config JobConfig) (*job, error) {
+	if config.NReduce <= 0 {
+		return nil, fmt.Errorf("job %s needs at least one reduce task", jobName)
+	}
+	err := checkEncoding(config.Options)
+	if err != nil {
+		return nil, err
+	}
+	err = checkKeyOrder(config.Options)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	if config.InputDir != "" {
+		files, err = getChildrenFiles(config.InputDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	splits, err := getSplits(files, config.Options.Input)
+	if err != nil {
+		return nil, err
+	}
+	j := &job{
+		jobName: jobName,
+		files:   files,
+		splits:  splits,
+		config:  config.withDefaults(),
+		done:    make(chan struct{}),
+		status:  JobStatus{Phase: "Pending"},
+
+		badRecords:  make(map[taskID]map[BadRecord]int),
+		attempts:    make(map[taskID]int),
+		lostOutputs: make(map[int]int),
+	}
+	j.ctx, j.stop = context.WithCancelCause(ctx)
+	return j, nil
+}
+
+// failedJob returns a job that failed with err before it could start, e.g.
+// because newJob rejected its configuration, so that Wait reports the error.
+func failedJob(jobName string, config JobConfig, err error) *job {
+	j := &job{
+		jobName: jobName,
+		config:  config.withDefaults(),
+		done:    make(chan struct{}),
+		err:     err,
+		status:  JobStatus{Phase: "Failed"},
+	}
+	j.ctx, j.stop = context.WithCancelCause(context.Background())
+	j.stop(nil)
+	close(j.done)
+	return j
+}
+
+// StartMaster starts a long-lived master that runs the jobs submitted to it,
+// either with SubmitJob or through the Master.Submit RPC, on a shared pool of
+// workers. It keeps running until Stop is called.
+func StartMaster(master string) (mr *Master) {
+	mr = newMaster(master)
+	mr.startRPCServer()
+	return
+}
+
+// SubmitJob starts a job on a long-lived master. Its name must differ from
+// those of the jobs already running on the master. A job that reads the output
+// of another one through JobOutput has no InputDir, and can only be submitted
+// once that job has completed.
+func (mr *Master) SubmitJob(jobName string, config JobConfig) error {
+	j, err := newJob(context.Background(), jobName, config)
+	if err != nil {
+		return err
+	}
+	mr.Lock()
+	if old, ok := mr.jobs[jobName]; ok && !isClosed(old.done) {
+		mr.Unlock()
+		return fmt.Errorf("job %s is already running", jobName)
+	}
+	mr.jobs[jobName] = j
+	mr.Unlock()
+
+	go mr.run(j, func(phase jobPhase) error {
+		return mr.schedule(j, phase)
+	})
+	return nil
+}
+
+// WaitJob blocks until the named job has completed, and returns the error that
+// failed it, if any.
+func (mr *Master) WaitJob(jobName string) error {
+	mr.Lock()
+	j, ok := mr.jobs[jobName]
+	mr.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown job %s", jobName)
+	}
+	<-j.done
+	return j.err
+}
+
+// ErrCancelled is the error of a cancelled job, whether CancelJob cancelled it
+// or the context it was started with was done; in the latter case the error
+// wraps the context's error as well.
+var ErrCancelled = errors.New("job cancelled")
+
+// CancelJob stops the named job: no more of its tasks are started, the workers
+// running its tasks are told to abandon them, and the partial output of those
+// tasks is removed. The job then fails with ErrCancelled and its status
+// becomes "Cancelled". Cancelling a job that has completed has no effect.
+func (mr *Master) CancelJob(jobName string) error {
+	mr.Lock()
+	j, ok := mr.jobs[jobName]
+	mr.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown job %s", jobName)
+	}
+	j.stop(ErrCancelled)
+	return nil
+}
+
+// cancelled returns the error of a job that has been cancelled, or nil.
+func (j *job) cancelled() error {
+	if j.ctx.Err() == nil {
+		return nil
+	}
+	cause := context.Cause(j.ctx)
+	if errors.Is(cause, ErrCancelled) {
+		return cause
+	}
+	return fmt.Errorf("%w: %w", ErrCancelled, cause)
+}
+
+// Stop waits for the submitted jobs to complete, then shuts down the workers
+// and the master's RPC server, after which Wait returns.
+func (mr *Master) Stop() {
+	mr.Lock()
+	jobs := make([]*job, 0, len(mr.jobs))
+	for _, j := range mr.jobs {
+		jobs = append(jobs, j)
+	}
+	mr.Unlock()
+	for _, j := range jobs {
+		<-j.done
+	}
+
+	mr.stats = mr.killWorkers()
+	mr.clients.close()
+	mr.stopRPCServer()
+	go func() {
+		mr.doneChannel <- true
+	}()
+}
+
+// Submit is an RPC method that starts a job on a long-lived master.
+func (mr *Master) Submit(args *SubmitArgs, _ *struct{}) error {
+	return mr.SubmitJob(args.JobName, args.Config)
+}
+
+// WaitForJob is an RPC method that returns once the named job has completed.
+// The RPC fails with the job's error if the job failed.
+func (mr *Master) WaitForJob(args *JobArgs, _ *struct{}) error {
+	return mr.WaitJob(args.JobName)
+}
+
+// Cancel is an RPC method that cancels the named job.
+func (mr *Master) Cancel(args *JobArgs, _ *struct{}) error {
+	return mr.CancelJob(args.JobName)
+}
+
+// mayTakeWorker records how many attempts a job has in flight and whether it
+// could use another worker, and tells whether it should get one. A job that
+// has work is entitled to an equal share of the slots of the live workers; it
+// may go over that share while no other job wants workers.
+func (mr *Master) mayTakeWorker(j *job, running int, wantsWorkers bool) bool {
+	mr.Lock()
+	defer mr.Unlock()
+	j.running = running
+	j.wantsWorkers = wantsWorkers
+	if !wantsWorkers {
+		return false
+	}
+
+	wanting := 0
+	for _, other := range mr.jobs {
+		if other.wantsWorkers && !isClosed(other.done) {
+			wanting++
+		}
+	}
+	if wanting <= 1 {
+		return true
+	}
+	live := mr.liveSlotsLocked()
+	share := (live + wanting - 1) / wanting
+	return running < share
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
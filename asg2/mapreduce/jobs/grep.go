@@ -0,0 +1,63 @@
+package jobs
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"asg2/mapreduce"
+)
+
+// Location is a line of an input file. Line numbers start at 1 with the first
+// line of the file, so grep jobs must read every file in a single split, as
+// the default WholeFileInput does.
+type Location struct {
+	File string
+	Line int
+}
+
+// locationSerde encodes a location as "file:line".
+type locationSerde struct{}
+
+func (locationSerde) Encode(l Location) string {
+	return l.File + ":" + strconv.Itoa(l.Line)
+}
+
+func (locationSerde) Decode(s string) (Location, error) {
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return Location{}, fmt.Errorf("no line number in %q", s)
+	}
+	line, err := strconv.Atoi(s[i+1:])
+	return Location{File: s[:i], Line: line}, err
+}
+
+// Grep finds the lines of the input files that match pattern. The output is
+// ordered by file and line number, with records such as "dir/a.txt:3: line".
+func Grep(name string, inputDir string, pattern *regexp.Regexp) *mapreduce.Job[Location, string, string] {
+	return &mapreduce.Job[Location, string, string]{
+		Name:   name,
+		Config: mapreduce.JobConfig{InputDir: inputDir, NReduce: 3},
+		Map: func(file string, contents string, _ mapreduce.Reporter) []mapreduce.Pair[Location, string] {
+			var pairs []mapreduce.Pair[Location, string]
+			for i, line := range strings.Split(contents, "\n") {
+				if pattern.MatchString(line) {
+					pairs = append(pairs, mapreduce.Pair[Location, string]{Key: Location{file, i + 1}, Value: line})
+				}
+			}
+			return pairs
+		},
+		Reduce: func(l Location, lines mapreduce.Iterator[string]) string {
+			line, _ := lines.Next()
+			return line
+		},
+		Less: func(a, b Location) bool {
+			if a.File != b.File {
+				return a.File < b.File
+			}
+			return a.Line < b.Line
+		},
+		Keys: locationSerde{},
+	}
+}
@@ -0,0 +1,48 @@
+package jobs
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"asg2/mapreduce"
+)
+
+// InvertedIndex lists, for every word of the input files, the number of files
+// it appears in followed by their names, as in "2 a.txt,b.txt".
+func InvertedIndex(name string, inputDir string) *mapreduce.Job[string, string, string] {
+	return &mapreduce.Job[string, string, string]{
+		Name:   name,
+		Config: mapreduce.JobConfig{InputDir: inputDir, NReduce: 3},
+		Map:    indexWords,
+		Reduce: listDocuments,
+	}
+}
+
+// indexWords emits every distinct word of a file once, with the file's name.
+func indexWords(file string, contents string, _ mapreduce.Reporter) []mapreduce.Pair[string, string] {
+	doc := filepath.Base(file)
+	seen := make(map[string]bool)
+	var pairs []mapreduce.Pair[string, string]
+	for _, word := range strings.Fields(contents) {
+		if !seen[word] {
+			seen[word] = true
+			pairs = append(pairs, mapreduce.Pair[string, string]{Key: word, Value: doc})
+		}
+	}
+	return pairs
+}
+
+func listDocuments(word string, docs mapreduce.Iterator[string]) string {
+	seen := make(map[string]bool)
+	var list []string
+	for doc, ok := docs.Next(); ok; doc, ok = docs.Next() {
+		if !seen[doc] {
+			seen[doc] = true
+			list = append(list, doc)
+		}
+	}
+	sort.Strings(list)
+	return strconv.Itoa(len(list)) + " " + strings.Join(list, ",")
+}
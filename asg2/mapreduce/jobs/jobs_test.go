@@ -0,0 +1,156 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"asg2/mapreduce"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden output files")
+
+// socket returns a unix socket path for a master or worker of the tests.
+func socket(name string) string {
+	s := filepath.Join(os.TempDir(), fmt.Sprintf("mrjobs-%d-%s", os.Getpid(), name))
+	os.Remove(s)
+	return s
+}
+
+// runJob runs a job, with Sequential or with Distributed on two workers, in
+// directories of its own, and returns its merged output.
+func runJob[K comparable, V any, R any](t *testing.T, job *mapreduce.Job[K, V, R], distributed bool) []byte {
+	job.Config.WorkDir = t.TempDir()
+	job.Config.OutputDir = t.TempDir()
+	var mr *mapreduce.Master
+	if distributed {
+		master := socket("master")
+		mr = job.Distributed(context.Background(), master)
+		for i := 0; i < 2; i++ {
+			go job.RunWorker(master, socket(fmt.Sprint("worker", i)), nil, 1, -1, false)
+		}
+	} else {
+		mr = job.Sequential(context.Background())
+	}
+	if err := mr.Wait(); err != nil {
+		t.Fatalf("job %s failed: %v\n", job.Name, err)
+	}
+	output, err := os.ReadFile(filepath.Join(job.Config.OutputDir, "mrtmp."+job.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return output
+}
+
+// checkGolden runs a job both ways and compares its output with the golden
+// file testdata/<job>.golden, which -update rewrites.
+func checkGolden[K comparable, V any, R any](t *testing.T, job *mapreduce.Job[K, V, R]) {
+	golden := filepath.Join("testdata", job.Name+".golden")
+	for _, distributed := range []bool{false, true} {
+		output := runJob(t, job, distributed)
+		if *update && !distributed {
+			if err := os.WriteFile(golden, output, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(output, want) {
+			t.Fatalf("output of %s (distributed: %v):\n%s\nexpected:\n%s", job.Name, distributed, output, want)
+		}
+	}
+}
+
+func TestWordCount(t *testing.T) {
+	checkGolden(t, WordCount("wordcount", "testdata/text"))
+}
+
+func TestInvertedIndex(t *testing.T) {
+	checkGolden(t, InvertedIndex("invertedindex", "testdata/text"))
+}
+
+func TestGrep(t *testing.T) {
+	checkGolden(t, Grep("grep", "testdata/text", regexp.MustCompile(`\b(fox|dog)\b`)))
+}
+
+func TestJoin(t *testing.T) {
+	checkGolden(t, Join("join", "testdata/join", "users"))
+}
+
+func TestTopK(t *testing.T) {
+	counts := WordCount("topk-counts", "testdata/text")
+	runJob(t, counts, false)
+	checkGolden(t, TopK("topk", counts.Output(), 3))
+}
+
+func TestTopKPipeline(t *testing.T) {
+	counts := WordCount("topk-counts", "testdata/text")
+	top := TopK("topk", mapreduce.JobOutput{}, 3)
+	stages := []mapreduce.Stage{counts.Stage(), top.Stage()}
+	outputDir := t.TempDir()
+	for i := range stages {
+		stages[i].Config.WorkDir = t.TempDir()
+		stages[i].Config.OutputDir = outputDir
+	}
+	if err := mapreduce.SequentialPipeline(context.Background(), stages).Wait(); err != nil {
+		t.Fatalf("pipeline failed: %v\n", err)
+	}
+	output, err := os.ReadFile(filepath.Join(outputDir, "mrtmp.topk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(filepath.Join("testdata", "topk.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output, want) {
+		t.Fatalf("output of the pipeline:\n%s\nexpected:\n%s", output, want)
+	}
+}
+
+func TestTopKBadCount(t *testing.T) {
+	// Every word is counted as "many", which is not a count.
+	counts := &mapreduce.Job[string, string, string]{
+		Name:   "topk-many",
+		Config: mapreduce.JobConfig{InputDir: "testdata/text", NReduce: 1},
+		Map: func(file string, contents string, _ mapreduce.Reporter) []mapreduce.Pair[string, string] {
+			return []mapreduce.Pair[string, string]{{Key: "fox", Value: "many"}}
+		},
+		Reduce: func(key string, values mapreduce.Iterator[string]) string {
+			return "many"
+		},
+	}
+	runJob(t, counts, false)
+	top := TopK("topk", counts.Output(), 3)
+	top.Config.WorkDir = t.TempDir()
+	top.Config.OutputDir = t.TempDir()
+	err := top.Sequential(context.Background()).Wait()
+	te, ok := err.(*mapreduce.TaskError)
+	if !ok || te.Kind != mapreduce.TaskBadInput || te.Record == nil || te.Record.Key != "fox" {
+		t.Fatalf("job failed with %v, expected bad input on key fox\n", err)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	job, err := New("grep", Settings{Name: "grep", InputDir: "testdata/text", NReduce: 1, Args: []string{`\b(fox|dog)\b`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.(*mapreduce.Job[Location, string, string]).Config.NReduce != 1 {
+		t.Fatalf("NReduce not applied\n")
+	}
+	checkGolden(t, job.(*mapreduce.Job[Location, string, string]))
+	if _, err := New("grep", Settings{Name: "grep"}); err == nil {
+		t.Fatalf("built grep without a pattern\n")
+	}
+	if _, err := New("missing", Settings{}); err == nil {
+		t.Fatalf("built a job that is not registered\n")
+	}
+}
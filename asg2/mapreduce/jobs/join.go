@@ -0,0 +1,60 @@
+package jobs
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"asg2/mapreduce"
+)
+
+// JoinRow is a row of one of the inputs of a join, without its key.
+type JoinRow struct {
+	Left bool // whether the row comes from the left input
+	Row  string
+}
+
+// Join joins two inputs of comma-separated rows on their first field. The
+// files of inputDir whose names start with leftPrefix hold the left input,
+// and the other files the right one. The result of a key lists every
+// combination of its left and right rows, as "key,left fields,right fields";
+// a key missing from either input has none. The rows of a key are held in
+// memory by its reduce function.
+func Join(name string, inputDir string, leftPrefix string) *mapreduce.Job[string, JoinRow, []string] {
+	return &mapreduce.Job[string, JoinRow, []string]{
+		Name:   name,
+		Config: mapreduce.JobConfig{InputDir: inputDir, NReduce: 3},
+		Map: func(file string, contents string, _ mapreduce.Reporter) []mapreduce.Pair[string, JoinRow] {
+			left := strings.HasPrefix(filepath.Base(file), leftPrefix)
+			var pairs []mapreduce.Pair[string, JoinRow]
+			for _, line := range strings.Split(contents, "\n") {
+				if line == "" {
+					continue
+				}
+				key, row, _ := strings.Cut(line, ",")
+				pairs = append(pairs, mapreduce.Pair[string, JoinRow]{Key: key, Value: JoinRow{left, row}})
+			}
+			return pairs
+		},
+		Reduce: joinRows,
+	}
+}
+
+func joinRows(key string, rows mapreduce.Iterator[JoinRow]) []string {
+	var left, right []string
+	for r, ok := rows.Next(); ok; r, ok = rows.Next() {
+		if r.Left {
+			left = append(left, r.Row)
+		} else {
+			right = append(right, r.Row)
+		}
+	}
+	joined := []string{}
+	for _, l := range left {
+		for _, r := range right {
+			joined = append(joined, key+","+l+","+r)
+		}
+	}
+	sort.Strings(joined)
+	return joined
+}
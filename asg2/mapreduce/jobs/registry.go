@@ -0,0 +1,105 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"asg2/mapreduce"
+)
+
+// Runnable is a job of the registry, whatever the types of its keys and
+// values. Every *mapreduce.Job is one.
+type Runnable interface {
+	Sequential(ctx context.Context) *mapreduce.Master
+	Distributed(ctx context.Context, master string) *mapreduce.Master
+	RunWorker(master string, me string, local []string, slots int, nRPC int, shutdownOnSignal bool)
+}
+
+// Settings are what a registered job is built from: the job's name, which
+// the master and its workers must agree on, its directories and number of
+// reduce tasks, and arguments of its own, such as the pattern of a grep job.
+// A zero NReduce or empty OutputDir keeps the job's default.
+type Settings struct {
+	Name      string
+	InputDir  string
+	OutputDir string
+	NReduce   int
+	Args      []string
+}
+
+// The registered jobs, by name.
+var registry = map[string]func(s Settings) (Runnable, error){
+	"wordcount": func(s Settings) (Runnable, error) {
+		return configure(WordCount(s.Name, s.InputDir), s), nil
+	},
+	"invertedindex": func(s Settings) (Runnable, error) {
+		return configure(InvertedIndex(s.Name, s.InputDir), s), nil
+	},
+	"grep": func(s Settings) (Runnable, error) {
+		if len(s.Args) != 1 {
+			return nil, fmt.Errorf("grep takes a pattern")
+		}
+		pattern, err := regexp.Compile(s.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		return configure(Grep(s.Name, s.InputDir, pattern), s), nil
+	},
+	"join": func(s Settings) (Runnable, error) {
+		if len(s.Args) != 1 {
+			return nil, fmt.Errorf("join takes the prefix of the left input's files")
+		}
+		return configure(Join(s.Name, s.InputDir, s.Args[0]), s), nil
+	},
+	"topk": func(s Settings) (Runnable, error) {
+		if len(s.Args) != 2 {
+			return nil, fmt.Errorf("topk takes the number of keys to keep and the name of a wordcount run")
+		}
+		k, err := strconv.Atoi(s.Args[0])
+		if err != nil || k <= 0 {
+			return nil, fmt.Errorf("topk: bad number of keys %q", s.Args[0])
+		}
+		// The counts are read where a wordcount run with its default
+		// settings leaves its reducer output.
+		counts := WordCount(s.Args[1], "")
+		return configure(TopK(s.Name, counts.Output(), k), s), nil
+	},
+}
+
+// Register makes a job available under the given name, for New to build.
+func Register(name string, newJob func(s Settings) (Runnable, error)) {
+	registry[name] = newJob
+}
+
+// New builds the job registered under the given name.
+func New(name string, s Settings) (Runnable, error) {
+	newJob, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown job %q", name)
+	}
+	return newJob(s)
+}
+
+// Names returns the names of the registered jobs, sorted.
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// configure applies the settings a job's constructor does not take.
+func configure[K comparable, V any, R any](j *mapreduce.Job[K, V, R], s Settings) *mapreduce.Job[K, V, R] {
+	if s.NReduce > 0 {
+		j.Config.NReduce = s.NReduce
+	}
+	if s.OutputDir != "" {
+		j.Config.OutputDir = s.OutputDir
+	}
+	return j
+}
@@ -0,0 +1,59 @@
+package jobs
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"asg2/mapreduce"
+)
+
+// Entry is a key and its count, as ranked by TopK.
+type Entry struct {
+	Key   string
+	Count int
+}
+
+// TopK finds the k keys with the largest counts in the reducer output of an
+// earlier job, such as WordCount, whose records are keys and their counts. As
+// a stage of a pipeline, it reads the output of the stage before it
+// instead. A count that is not an integer fails the map task reading it. Every
+// map task and its combiner only pass on their own top k, to the single reduce
+// task. The result is the "top" record, listing the entries from the largest
+// count down, ties broken by key.
+func TopK(name string, counts mapreduce.JobOutput, k int) *mapreduce.Job[string, []Entry, []Entry] {
+	top := func(key string, lists mapreduce.Iterator[[]Entry]) []Entry {
+		var entries []Entry
+		for list, ok := lists.Next(); ok; list, ok = lists.Next() {
+			entries = append(entries, list...)
+		}
+		return topEntries(entries, k)
+	}
+	return &mapreduce.Job[string, []Entry, []Entry]{
+		Name:   name,
+		Config: mapreduce.JobConfig{NReduce: 1, Options: mapreduce.JobOptions{Input: counts}},
+		TryMap: func(key string, value string, _ mapreduce.Reporter) ([]mapreduce.Pair[string, []Entry], error) {
+			count, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("count of %q: %v", key, err)
+			}
+			return []mapreduce.Pair[string, []Entry]{{Key: "top", Value: []Entry{{key, count}}}}, nil
+		},
+		Reduce:  top,
+		Combine: top,
+	}
+}
+
+// topEntries returns the k entries with the largest counts, in order.
+func topEntries(entries []Entry, k int) []Entry {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	if len(entries) > k {
+		entries = entries[:k]
+	}
+	return entries
+}
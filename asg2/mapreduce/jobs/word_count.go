@@ -0,0 +1,48 @@
+// Package jobs holds reference MapReduce jobs built on the typed Job API:
+// word count, inverted index, distributed grep, reduce-side join and global
+// top-K. Each constructor describes the job over the files of an input
+// directory; the same Job runs with Sequential, or with Distributed on
+// workers started with its RunWorker.
+package jobs
+
+import (
+	"strings"
+
+	"asg2/mapreduce"
+)
+
+// WordCount counts the occurrences of every word in the input files.
+func WordCount(name string, inputDir string) *mapreduce.Job[string, int, int] {
+	return &mapreduce.Job[string, int, int]{
+		Name: name,
+		Config: mapreduce.JobConfig{
+			InputDir: inputDir,
+			NReduce:  3,
+			// Counts are small integers, so the compact binary encoding
+			// is much cheaper to write and parse than JSON.
+			Options: mapreduce.JobOptions{Codec: "binary"},
+		},
+		Map:     countWords,
+		Reduce:  sum,
+		Combine: sum,
+	}
+}
+
+func countWords(file string, contents string, _ mapreduce.Reporter) []mapreduce.Pair[string, int] {
+	words := strings.Fields(contents)
+	pairs := make([]mapreduce.Pair[string, int], 0, len(words))
+	for _, word := range words {
+		pairs = append(pairs, mapreduce.Pair[string, int]{Key: word, Value: 1})
+	}
+	return pairs
+}
+
+// sum adds up the partial counts of a key. Because it accepts its own output
+// as input, it doubles as the combiner for map tasks.
+func sum(key string, counts mapreduce.Iterator[int]) int {
+	total := 0
+	for n, ok := counts.Next(); ok; n, ok = counts.Next() {
+		total += n
+	}
+	return total
+}
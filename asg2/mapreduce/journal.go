@@ -0,0 +1,191 @@
+package mapreduce
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+)
+
+// A journal records the tasks of a job whose output has been committed, so that
+// a master restarted after a crash can resume the job instead of starting it
+// over. It is a file of JSON records: a journalHeader identifying the job,
+// followed by one journalEntry per committed task. A map task whose output was
+// lost with its worker is retracted by an entry with a negative attempt, and
+// the journal of a job that completed ends with an entry marking it done, so
+// that running the job again starts it over.
+type journal struct {
+	file      *os.File
+	encoder   *json.Encoder
+	committed map[taskID]journalEntry // the attempt whose output was committed
+}
+
+type journalHeader struct {
+	JobName     string
+	Fingerprint string
+}
+
+type journalEntry struct {
+	Phase   jobPhase
+	Task    int
+	Attempt int
+	Worker  string `json:",omitempty"` // holds the output of a map task shuffled between workers
+	Done    bool   `json:",omitempty"` // the job completed; the entry records no task
+}
+
+// taskID identifies a task of a job.
+type taskID struct {
+	Phase jobPhase
+	Task  int
+}
+
+// inputVersion tells an input file apart from a later version of it.
+type inputVersion struct {
+	Size    int64
+	ModTime int64
+}
+
+// jobFingerprint summarizes everything that determines the tasks of a job and
+// the layout of their output, including the size and modification time of its
+// input files. A journal is only resumed by a run of the job with the same
+// fingerprint.
+func jobFingerprint(splits []InputSplit, nReduce int, options JobOptions) string {
+	inputs := make(map[string]inputVersion)
+	for _, s := range splits {
+		for _, r := range s.Ranges {
+			if _, ok := inputs[r.File]; ok {
+				continue
+			}
+			// An input that cannot be read fails its map task anyway.
+			if info, err := os.Stat(r.File); err == nil {
+				inputs[r.File] = inputVersion{info.Size(), info.ModTime().UnixNano()}
+			}
+		}
+	}
+	b, err := json.Marshal(struct {
+		Splits       []InputSplit
+		Inputs       map[string]inputVersion
+		NReduce      int
+		Combine      bool
+		Partitioner  Partitioner
+		Codec        string
+		Compression  string
+		LocalShuffle bool   `json:",omitempty"`
+		KeyOrder     string `json:",omitempty"`
+		Grouping     string `json:",omitempty"`
+	}{splits, inputs, nReduce, options.Combine, options.Partitioner, options.Codec, options.Compression, options.LocalShuffle, options.KeyOrder, options.Grouping})
+	checkError(err)
+	h := fnv.New64a()
+	h.Write(b)
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// readJournal returns the tasks committed in an existing journal. It returns
+// false if there is no journal, if it was written by a different job, or if
+// the job completed.
+func readJournal(fileName string, header journalHeader) (map[taskID]journalEntry, bool) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+
+	dec := json.NewDecoder(file)
+	var h journalHeader
+	if dec.Decode(&h) != nil || h != header {
+		return nil, false
+	}
+	committed := make(map[taskID]journalEntry)
+	for {
+		// A crash may have cut the last entry short; it is simply dropped.
+		var e journalEntry
+		if dec.Decode(&e) != nil {
+			break
+		}
+		if e.Done {
+			return nil, false
+		}
+		if e.Attempt < 0 {
+			delete(committed, taskID{e.Phase, e.Task})
+			continue
+		}
+		committed[taskID{e.Phase, e.Task}] = e
+	}
+	return committed, true
+}
+
+// openJournal starts a new journal, or continues one whose committed entries
+// were returned by readJournal.
+func openJournal(fileName string, header journalHeader, committed map[taskID]journalEntry) (*journal, error) {
+	j := &journal{committed: committed}
+	if j.committed == nil {
+		j.committed = make(map[taskID]journalEntry)
+	}
+
+	// Rewrite the journal rather than append to it, so that a partial entry
+	// left by a crash does not corrupt the entries that follow. The new copy
+	// only replaces the old one once it is complete.
+	file, err := os.Create(fileName + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	j.file = file
+	j.encoder = json.NewEncoder(file)
+	err = j.encoder.Encode(header)
+	for _, e := range j.committed {
+		if err == nil {
+			err = j.encoder.Encode(e)
+		}
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(fileName+".tmp", fileName)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// isCommitted reports whether a task's output was committed by this or an
+// earlier run of the job.
+func (j *journal) isCommitted(phase jobPhase, task int) bool {
+	_, ok := j.committed[taskID{phase, task}]
+	return ok
+}
+
+// commit durably records that the output of the given attempt at a task has
+// been committed. Worker is only set for map output kept by the worker that
+// produced it.
+func (j *journal) commit(phase jobPhase, task int, attempt int, worker string) error {
+	e := journalEntry{Phase: phase, Task: task, Attempt: attempt, Worker: worker}
+	j.committed[taskID{phase, task}] = e
+	return j.write(e)
+}
+
+// retract durably records that a task's committed output has been lost, so
+// that the task is run again.
+func (j *journal) retract(phase jobPhase, task int) error {
+	delete(j.committed, taskID{phase, task})
+	return j.write(journalEntry{Phase: phase, Task: task, Attempt: -1})
+}
+
+// complete durably records that the job completed, so that it is not resumed.
+func (j *journal) complete() error {
+	return j.write(journalEntry{Done: true})
+}
+
+func (j *journal) write(e journalEntry) error {
+	err := j.encoder.Encode(e)
+	if err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+func (j *journal) close() {
+	j.file.Close()
+}
@@ -0,0 +1,58 @@
+package mapreduce
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A worker that has no map task with local input to run waits for up to
+// localityDelay for one to come up before it is given a task whose input is
+// remote, unless no live worker can read that input locally.
+var localityDelay = 500 * time.Millisecond
+
+// isLocalTo tells whether a worker that reads the given directories or hosts
+// locally holds the split's input: one of its hosts, or the directory of one of
+// its files, is among them.
+func (s InputSplit) isLocalTo(local []string) bool {
+	for _, l := range local {
+		for _, host := range s.Hosts {
+			if host == l {
+				return true
+			}
+		}
+		for _, r := range s.Ranges {
+			if inDir(r.File, l) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// inDir tells whether file lies in dir or one of its subdirectories.
+func inDir(file string, dir string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(file))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// isLocal tells whether a worker advertised that it reads the split's input
+// locally when it registered.
+func (mr *Master) isLocal(worker string, split InputSplit) bool {
+	mr.Lock()
+	defer mr.Unlock()
+	return split.isLocalTo(mr.workerLocal[worker])
+}
+
+// hasLocalWorker tells whether any live worker reads the split's input
+// locally, i.e. whether it is worth waiting for one to become idle.
+func (mr *Master) hasLocalWorker(split InputSplit) bool {
+	mr.Lock()
+	defer mr.Unlock()
+	for _, w := range mr.workers {
+		if mr.stateLocked(w) != WorkerDead && split.isLocalTo(mr.workerLocal[w]) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,63 +1,162 @@
 package mapreduce
 
 import (
-	"encoding/json"
+	"container/heap"
+	"context"
 	"hash/fnv"
-	"log"
 	"os"
 	"sort"
 )
 
 func runMapTask(
+	ctx context.Context, // Abandons the task once done
 	jobName string, // The name of the whole mapreduce job
+	workDir string, // Where the job's intermediate files live
 	mapTaskIndex int, // The index of the map task
-	inputFile string, // The path to the input file assigned to this task
+	attempt int, // Which execution of the map task this is
+	split InputSplit, // The input assigned to this task
 	nReduce int, // The number of reduce tasks that will be run
-	mapFn func(file string, contents string) []KeyValue, // The user-defined map function
-) {
-	file, err := os.Open(inputFile)
-	if err != nil {
-		log.Fatal(err)
-		return
+	mapFn func(file string, contents string, r Reporter) []KeyValue, // The user-defined map function
+	combineF func(key string, values ValueIterator) string, // The optional user-defined combiner (nil to disable)
+	skip []BadRecord, // Records that user functions panicked on too often
+	options JobOptions, // The job's partitioner and file encoding
+	stats *taskStats, // Where the task reports its progress and counters (nil to discard)
+) error {
+	fail := func(err error) error {
+		return newTaskError(mapPhase, mapTaskIndex, err)
 	}
-	defer file.Close()
+	skipped := skipSet(skip)
 
-	fileInfo, err := file.Stat()
-	if err != nil {
-		log.Fatal(err)
-		return
+	var keyvals []KeyValue
+	mapInput := func(record BadRecord, key string, value string) error {
+		if skipped[record] {
+			return nil
+		}
+		return protect(mapPhase, mapTaskIndex, &record, func() {
+			keyvals = append(keyvals, mapFn(key, value, stats)...)
+		})
+	}
+	for _, r := range split.Ranges {
+		stats.input(r.Length)
+	}
+	for _, r := range split.Ranges {
+		if err := ctx.Err(); err != nil {
+			return fail(err)
+		}
+		if in, ok := options.Input.(JobOutput); ok {
+			records, err := in.readRecords(r, stats)
+			if err != nil {
+				return fail(err)
+			}
+			for _, kv := range records {
+				err = mapInput(BadRecord{File: r.File, Key: kv.Key}, kv.Key, kv.Value)
+				if err != nil {
+					return fail(err)
+				}
+			}
+			continue
+		}
+		contents, err := readRange(r)
+		stats.read(int64(len(contents)))
+		if err == nil {
+			err = mapInput(BadRecord{File: r.File, Offset: r.Offset}, r.File, string(contents))
+		}
+		if err != nil {
+			return fail(err)
+		}
 	}
 
-	fileSize := fileInfo.Size()
-	fileContent := make([]byte, fileSize)
-	_, err = file.Read(fileContent)
+	partitioner := options.Partitioner
+	if partitioner == nil {
+		partitioner = HashPartitioner{}
+	}
+	less := keyLess(options)
+	partitions := make([][]KeyValue, nReduce)
+	var record BadRecord
+	err := protect(mapPhase, mapTaskIndex, &record, func() {
+		for _, keyval := range keyvals {
+			// Skipping a key leaves it out of the map output, so that
+			// neither the partitioner nor the combiner sees it.
+			record = BadRecord{Key: keyval.Key}
+			if skipped[record] {
+				continue
+			}
+			reduceTaskIndex := partitioner.Partition(keyval.Key, nReduce)
+			partitions[reduceTaskIndex] = append(partitions[reduceTaskIndex], keyval)
+		}
+	})
 	if err != nil {
-		log.Fatal(err)
-		return
+		return fail(err)
 	}
 
-	keyvals := mapFn(inputFile, string(fileContent))
-
-	encoders := make([]*json.Encoder, nReduce)
 	for i := 0; i < nReduce; i++ {
-		fileName := getIntermediateName(jobName, mapTaskIndex, i)
+		if err := ctx.Err(); err != nil {
+			return fail(err)
+		}
+		fileName := getAttemptName(getIntermediateName(workDir, jobName, mapTaskIndex, i), attempt)
 		file, err := os.Create(fileName)
 		if err != nil {
-			log.Fatal(err)
-			return
+			return fail(err)
 		}
 		defer file.Close()
-		encoders[i] = json.NewEncoder(file)
+
+		// Each partition is written sorted by key, as a run that the reduce
+		// task merges with the runs of the other map tasks.
+		partition := partitions[i]
+		if combineF != nil {
+			record = BadRecord{}
+			err = protect(mapPhase, mapTaskIndex, &record, func() {
+				partition = combine(partition, less, stats, func(key string, values ValueIterator) string {
+					record = BadRecord{Key: key}
+					return combineF(key, values)
+				})
+			})
+			if err != nil {
+				return fail(err)
+			}
+		} else {
+			sort.SliceStable(partition, func(a, b int) bool {
+				return less(partition[a].Key, partition[b].Key)
+			})
+		}
+		writer, err := newRecordWriter(countingWriter{file, stats}, options)
+		if err != nil {
+			return fail(err)
+		}
+		for _, keyval := range partition {
+			err := writer.Encode(keyval)
+			if err != nil {
+				return fail(err)
+			}
+		}
+		err = writer.Close()
+		if err != nil {
+			return fail(err)
+		}
 	}
+	return nil
+}
 
+// combine pre-aggregates the map output of a single partition by applying the
+// user-defined combiner to the values of each key, so that only one record per
+// key is written to the intermediate file. The result is sorted by key in the
+// given order.
+func combine(keyvals []KeyValue, less func(a, b string) bool, stats *taskStats, combineF func(string, ValueIterator) string) []KeyValue {
+	grouped := make(map[string][]string)
+	var keys []string
 	for _, keyval := range keyvals {
-		reduceTaskIndex := int(hash32(keyval.Key)) % nReduce
-		err := encoders[reduceTaskIndex].Encode(keyval)
-		if err != nil {
-			log.Fatal(err)
-			return
+		if _, ok := grouped[keyval.Key]; !ok {
+			keys = append(keys, keyval.Key)
 		}
+		grouped[keyval.Key] = append(grouped[keyval.Key], keyval.Value)
 	}
+	sortKeys(keys, less)
+
+	combined := make([]KeyValue, 0, len(keys))
+	for _, key := range keys {
+		combined = append(combined, KeyValue{Key: key, Value: combineF(key, &sliceIterator{values: grouped[key], stats: stats})})
+	}
+	return combined
 }
 
 func hash32(s string) uint32 {
@@ -67,48 +166,95 @@ func hash32(s string) uint32 {
 }
 
 func runReduceTask(
+	ctx context.Context, // abandons the task once done
 	jobName string, // the name of the whole MapReduce job
+	workDir string, // where the job's intermediate files live
 	reduceTaskIndex int, // the index of the reduce task
+	attempt int, // which execution of the reduce task this is
 	nMap int, // the number of map tasks that were run
-	reduceFn func(key string, values []string) string,
-) {
-	keyvals := make(map[string][]string)
+	reduceFn func(key string, values ValueIterator) string,
+	skip []BadRecord, // keys that reduceFn panicked on too often
+	options JobOptions, // the job's file encoding
+	mapOutputs []MapOutput, // where to fetch the map outputs from (nil to read them from workDir)
+	clients *rpcClients, // the connections to fetch map outputs over (nil to dial for every fetch)
+	stats *taskStats, // where the task reports its progress and counters (nil to discard)
+) error {
+	fail := func(err error) error {
+		return newTaskError(reducePhase, reduceTaskIndex, err)
+	}
+	skipped := skipSet(skip)
+
+	// Every map task wrote its output for this reduce task sorted by key, so
+	// the keys are visited in order by merging the nMap runs, and only the
+	// head record of each run is held in memory. Consecutive keys in the same
+	// group of the job's key grouping are reduced together, their values in
+	// key order, and the result is written under the key of the group.
+	readers := make([]*runReader, 0, nMap)
+	runs := runHeap{less: keyLess(options)}
+	grouping := groupingOf(options)
 	for i := 0; i < nMap; i++ {
-		fileName := getIntermediateName(jobName, i, reduceTaskIndex)
-		file, err := os.OpenFile(fileName, os.O_RDONLY, 0644)
+		file, err := openRun(workDir, jobName, i, reduceTaskIndex, mapOutputs, clients, stats)
 		if err != nil {
-			log.Fatal(err)
-			return
-		}
-		decoder := json.NewDecoder(file)
-		var keyval KeyValue
-		for decoder.Decode(&keyval) == nil {
-			keyvals[keyval.Key] = append(keyvals[keyval.Key], keyval.Value)
+			return fail(err)
 		}
 		defer file.Close()
+		decoder, err := newRecordReader(countingReader{file, stats}, options)
+		if err != nil {
+			return fail(err)
+		}
+		run := &runReader{index: i, decoder: decoder}
+		readers = append(readers, run)
+		if run.advance() {
+			runs.runs = append(runs.runs, run)
+		}
 	}
-	
-	file := getReduceOutName(jobName, reduceTaskIndex)
+	heap.Init(&runs)
+
+	file := getAttemptName(getReduceOutName(workDir, jobName, reduceTaskIndex), attempt)
 	outputFile, err := os.Create(file)
 	if err != nil {
-		log.Fatal(err)
-		return
+		return fail(err)
 	}
-	
-	var keys []string
-	for key := range keyvals {
-		keys = append(keys, key)
+	defer outputFile.Close()
+
+	writer, err := newRecordWriter(countingWriter{outputFile, stats}, options)
+	if err != nil {
+		return fail(err)
 	}
-	sort.Strings(keys)
-	
-	encoder := json.NewEncoder(outputFile)
-	for _, key := range keys {
-		value := keyvals[key]
-		output := reduceFn(key, value)
-		err := encoder.Encode(KeyValue{Key: key, Value: output})
+	for runs.Len() > 0 {
+		if err := ctx.Err(); err != nil {
+			return fail(err)
+		}
+		key := runs.runs[0].head.Key
+		values := &groupIterator{runs: &runs, key: key, same: grouping.same, stats: stats}
+		record := BadRecord{Key: key}
+		if skipped[record] {
+			values.skip()
+			continue
+		}
+		var output string
+		err := protect(reducePhase, reduceTaskIndex, &record, func() {
+			output = reduceFn(key, values)
+		})
+		if err != nil {
+			return fail(err)
+		}
+		values.skip()
+		err = writer.Encode(KeyValue{Key: grouping.groupKey(key), Value: output})
 		if err != nil {
-			log.Fatal(err)
+			return fail(err)
 		}
 	}
-	defer outputFile.Close()
+	// A run that could not be decoded ended early, and took some of its
+	// records with it.
+	for _, run := range readers {
+		if run.err != nil {
+			return fail(run.err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		return fail(err)
+	}
+	return nil
 }
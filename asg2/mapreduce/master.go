@@ -1,11 +1,13 @@
 package mapreduce
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net"
 	"os"
 	"sync"
+	"time"
 )
 
 // Master holds all the state that the master needs to keep track of. Of
@@ -17,13 +19,19 @@ type Master struct {
 	address         string
 	registerChannel chan string
 	doneChannel     chan bool
-	workers         []string // protected by the mutex
+	workers         []string                  // protected by the mutex
+	lastHeartbeat   map[string]time.Time      // protected by the mutex
+	workerTasks     map[string][]TaskProgress // attempts each worker last reported, protected by the mutex
+	workerLocal     map[string][]string       // what each worker reads locally, protected by the mutex
+	workerSlots     map[string]int            // tasks each worker runs at once, protected by the mutex
+	workerJoins     map[string]int            // times each worker's slots were put in the pool, protected by the mutex
+	clients         *rpcClients               // connections to the workers
 
-	// Per-task information
-	jobName string   // Name of currently executing job
-	files   []string // Input files
-	dirName string   // Parent of input files
-	nReduce int      // Number of reduce partitions
+	// The job started by Sequential or Distributed, or the current stage of
+	// a pipeline; a long-lived master started by StartMaster only has the
+	// jobs submitted to it, and leaves single nil.
+	single *job
+	jobs   map[string]*job // protected by the mutex
 
 	shutdown chan struct{}
 	l        net.Listener
@@ -31,14 +39,33 @@ type Master struct {
 }
 
 // Register is an RPC method that is called by workers after they have started
-// up to report that they are ready to receive tasks.
+// up to report that they are ready to receive tasks, how many at once, and
+// which input they read locally. A worker with several slots is put in the pool
+// once per slot, so that it is given that many tasks.
 func (mr *Master) Register(args *RegisterArgs, _ *struct{}) error {
 	mr.Lock()
 	defer mr.Unlock()
 	debug("Register: worker %s\n", args.Worker)
-	mr.workers = append(mr.workers, args.Worker)
+	mr.workerLocal[args.Worker] = args.Local
+	slots := args.Slots
+	if slots < 1 {
+		slots = 1
+	}
+	mr.workerSlots[args.Worker] = slots
+	_, known := mr.lastHeartbeat[args.Worker]
+	if known && mr.stateLocked(args.Worker) != WorkerDead {
+		mr.lastHeartbeat[args.Worker] = time.Now()
+		return nil // already in the pool
+	}
+	if !known {
+		mr.workers = append(mr.workers, args.Worker)
+	}
+	mr.lastHeartbeat[args.Worker] = time.Now()
+	mr.workerJoins[args.Worker]++
 	go func() {
-		mr.registerChannel <- args.Worker
+		for i := 0; i < slots; i++ {
+			mr.registerChannel <- args.Worker
+		}
 	}()
 	return nil
 }
@@ -49,112 +76,278 @@ func newMaster(master string) (mr *Master) {
 	mr.address = master
 	mr.shutdown = make(chan struct{})
 	mr.registerChannel = make(chan string)
+	mr.lastHeartbeat = make(map[string]time.Time)
+	mr.workerTasks = make(map[string][]TaskProgress)
+	mr.workerLocal = make(map[string][]string)
+	mr.workerSlots = make(map[string]int)
+	mr.workerJoins = make(map[string]int)
+	mr.clients = newRPCClients()
 	mr.doneChannel = make(chan bool)
+	mr.jobs = make(map[string]*job)
 	return
 }
 
 // Sequential runs map and reduce tasks sequentially, waiting for each task to
-// complete before scheduling the next.
-func Sequential(jobName string, dirName string, nreduce int,
-	mapF func(string, string) []KeyValue,
-	reduceF func(string, []string) string,
+// complete before scheduling the next. combineF may be nil, in which case map
+// output is written to the intermediate files without pre-aggregation;
+// config.Options.Combine is ignored, and so is LocalShuffle since there are no
+// other workers. Once ctx is done, the task being run is abandoned and the job
+// fails with ErrCancelled. A job whose configuration is invalid fails without
+// running, with Wait returning why.
+func Sequential(ctx context.Context, jobName string, config JobConfig,
+	mapF func(string, string, Reporter) []KeyValue,
+	reduceF func(string, ValueIterator) string,
+	combineF func(string, ValueIterator) string,
 ) (mr *Master) {
-	files := getChildrenFiles(dirName)
+	config.Options.Combine = combineF != nil
+	config.Options.LocalShuffle = false
+	j, err := newJob(ctx, jobName, config)
+	if err != nil {
+		j = failedJob(jobName, config, err)
+	}
 	mr = newMaster("master")
-	mr.dirName = dirName
-	go mr.run(jobName, files, nreduce, func(phase jobPhase) {
-		switch phase {
-		case mapPhase:
-			for i, f := range mr.files {
-				runMapTask(mr.jobName, i, f, mr.nReduce, mapF)
+	mr.single = j
+	mr.jobs[jobName] = j
+	go func() {
+		if err == nil {
+			mr.run(j, mr.sequentialSchedule(j, mapF, reduceF, combineF))
+			mr.stats = []int{len(j.splits) + j.config.NReduce}
+		}
+		mr.doneChannel <- true
+	}()
+	return
+}
+
+// sequentialSchedule returns a schedule function for run that executes the
+// tasks of a job one after the other, in the master's own process. Since
+// there is no other worker to retry on, the first task that fails fails the
+// job, except that a job skipping bad records runs a task that panicked on a
+// record again until the record is skipped.
+func (mr *Master) sequentialSchedule(j *job,
+	mapF func(string, string, Reporter) []KeyValue,
+	reduceF func(string, ValueIterator) string,
+	combineF func(string, ValueIterator) string,
+) func(phase jobPhase) error {
+	runTask := func(phase jobPhase, task int) error {
+		for {
+			skip := j.skipList(phase, task)
+			stats := newTaskStats()
+			var err error
+			switch phase {
+			case mapPhase:
+				err = runMapTask(j.ctx, j.jobName, j.config.WorkDir, task, 0, j.splits[task], j.config.NReduce, mapF, combineF, skip, j.config.Options, stats)
+			case reducePhase:
+				err = runReduceTask(j.ctx, j.jobName, j.config.WorkDir, task, 0, len(j.splits), reduceF, skip, j.config.Options, nil, nil, stats)
 			}
-		case reducePhase:
-			for i := 0; i < mr.nReduce; i++ {
-				runReduceTask(mr.jobName, i, len(mr.files), reduceF)
+			if err == nil {
+				err = j.commitTask(phase, task, 0, "")
+				if err == nil {
+					mr.addCommitted(j, stats.snapshot())
+				}
+				return err
 			}
+			j.discardAttempt(phase, task, 0)
+			if cancelled := j.cancelled(); cancelled != nil {
+				return cancelled
+			}
+			te := newTaskError(phase, task, err)
+			if te.Record == nil || j.config.SkipBadRecords <= 0 {
+				return err
+			}
+			j.noteBadRecord(te)
 		}
-	}, func() {
-		mr.stats = []int{len(files) + nreduce}
-	})
-	return
+	}
+
+	return func(phase jobPhase) error {
+		ntasks := len(j.splits)
+		if phase == reducePhase {
+			ntasks = j.config.NReduce
+		}
+		nDone := 0
+		for i := 0; i < ntasks; i++ {
+			if j.journal.isCommitted(phase, i) {
+				nDone++
+			}
+		}
+		for i := 0; i < ntasks; i++ {
+			if j.journal.isCommitted(phase, i) {
+				continue
+			}
+			if cancelled := j.cancelled(); cancelled != nil {
+				return cancelled
+			}
+			mr.setTasks(j, nDone, 1, ntasks-nDone-1)
+			err := runTask(phase, i)
+			if err != nil {
+				return err
+			}
+			nDone++
+		}
+		mr.setTasks(j, nDone, 0, ntasks-nDone)
+		return nil
+	}
 }
 
 // Distributed schedules map and reduce tasks on workers that register with the
-// master over RPC.
-func Distributed(jobName string, dirName string, nreduce int, master string) (mr *Master) {
-	files := getChildrenFiles(dirName)
+// master over RPC. The master listens on a unix socket path or on a URL of the
+// form unix:///path or tcp://host:port; with a tcp port of 0, mr.address holds
+// the port that was picked once Distributed returns. The job's work directory
+// and options are sent to the workers along with every task, so that they all
+// find the intermediate files and combine, partition and encode records the
+// same way. Once the job completes, the workers and the master are shut down.
+// The job is cancelled, as CancelJob does, once ctx is done. A job whose
+// configuration is invalid fails without running, as with Sequential.
+func Distributed(ctx context.Context, jobName string, config JobConfig, master string) (mr *Master) {
+	j, err := newJob(ctx, jobName, config)
+	if err != nil {
+		j = failedJob(jobName, config, err)
+	}
 	mr = newMaster(master)
+	mr.single = j
+	mr.jobs[jobName] = j
 	mr.startRPCServer()
-	mr.dirName = dirName
-	go mr.run(jobName, files, nreduce, mr.schedule, func() {
-		mr.stats = mr.killWorkers()
-		mr.stopRPCServer()
-	})
+	go mr.Stop()
+	if err == nil {
+		go mr.run(j, func(phase jobPhase) error {
+			return mr.schedule(j, phase)
+		})
+	}
 	return
 }
 
 // run executes a mapreduce job on the given number of mappers and reducers.
 //
-// First, it divides up the input file among the given number of mappers, and
-// schedules each task on workers as they become available. Each map task bins
-// its output in a number of bins equal to the given number of reduce tasks.
-// Once all the mappers have finished, workers are assigned reduce tasks.
+// First, it schedules a map task for each input split on workers as they
+// become available. Each map task bins its output in a number of bins equal
+// to the given number of reduce tasks. Once all the mappers have finished,
+// workers are assigned reduce tasks.
 //
-// When all tasks have been completed, the reducer outputs are merged,
-// statistics are collected, and the master is shut down.
+// When all tasks have been completed, the reducer outputs are merged, the
+// files the job's retention policy does not keep are removed, and the job is
+// marked as done.
 //
-// Note that this implementation assumes a shared file system.
-func (mr *Master) run(jobName string, files []string, nreduce int,
-	schedule func(phase jobPhase),
-	finish func(),
-) {
-	os.RemoveAll(outTestPath)
-	err := os.Mkdir(outTestPath, 0755)
-	if err != nil {
-		log.Fatal("master.run: ", err)
+// Every completed task is recorded in the job's journal. If a previous run of
+// the same job left a journal behind, its output directory is kept and the
+// tasks it committed are not scheduled again. Otherwise the job's directory
+// is emptied, leaving the files of other jobs alone.
+//
+// Note that this implementation assumes a shared file system, for the input
+// and the reducer outputs at least. A job that shuffles map output between
+// workers goes back to the map phase whenever the output of a map task is lost
+// with its worker before the reduce phase completes, and runs that task again.
+// The reduce tasks committed until then are kept. The workers drop the map
+// output of a job that completes or is cancelled; a failed job leaves it for
+// a later run to resume from.
+func (mr *Master) run(j *job, schedule func(phase jobPhase) error) {
+	j.err = mr.execute(j, schedule)
+	if j.config.Options.LocalShuffle && (j.err == nil || errors.Is(j.err, ErrCancelled)) {
+		mr.dropMapOutputs(j)
 	}
+	if errors.Is(j.err, ErrCancelled) {
+		mr.setPhase(j, "Cancelled")
+		debug("%s: Map/Reduce task %s cancelled\n", mr.address, j.jobName)
+	} else if j.err != nil {
+		mr.setPhase(j, "Failed")
+		debug("%s: Map/Reduce task %s failed: %v\n", mr.address, j.jobName, j.err)
+	} else {
+		mr.setPhase(j, "Done")
+		debug("%s: Map/Reduce task %s completed\n", mr.address, j.jobName)
+	}
+	j.stop(nil) // releases the job's context
+	close(j.done)
+}
 
-	mr.jobName = jobName
-	mr.files = files
-	mr.nReduce = nreduce
-
-	debug("%s: Starting Map/Reduce task %s\n", mr.address, mr.jobName)
-
-	schedule(mapPhase)
-	schedule(reducePhase)
-	finish()
-	mr.merge()
+// execute does the work of run, stopping at the first error.
+func (mr *Master) execute(j *job, schedule func(phase jobPhase) error) error {
+	header := journalHeader{j.jobName, jobFingerprint(j.splits, j.config.NReduce, j.config.Options)}
+	committed, resumed := readJournal(getJournalName(j.config.WorkDir, j.jobName), header)
+	if !resumed {
+		os.RemoveAll(getJobDir(j.config.WorkDir, j.jobName))
+		err := os.MkdirAll(getJobDir(j.config.WorkDir, j.jobName), 0755)
+		if err != nil {
+			return err
+		}
+	}
+	err := os.MkdirAll(j.config.OutputDir, 0755)
+	if err != nil {
+		return err
+	}
+	journal, err := openJournal(getJournalName(j.config.WorkDir, j.jobName), header, committed)
+	if err != nil {
+		return err
+	}
+	j.journal = journal
+	defer j.journal.close()
 
-	debug("%s: Map/Reduce task completed\n", mr.address)
+	if resumed {
+		debug("%s: Resuming Map/Reduce task %s (%d tasks already done)\n", mr.address, j.jobName, len(committed))
+	} else {
+		debug("%s: Starting Map/Reduce task %s\n", mr.address, j.jobName)
+	}
 
-	mr.doneChannel <- true
+	for {
+		mr.setPhase(j, string(mapPhase))
+		err = schedule(mapPhase)
+		if err != nil {
+			return err
+		}
+		mr.setPhase(j, string(reducePhase))
+		err = schedule(reducePhase)
+		if err != errMapOutputLost {
+			break
+		}
+		debug("%s: Map/Reduce task %s lost map output, running it again\n", mr.address, j.jobName)
+	}
+	if err != nil {
+		return err
+	}
+	err = j.merge()
+	if err != nil {
+		return err
+	}
+	err = j.journal.complete()
+	if err != nil {
+		return err
+	}
+	j.discardOutputs(j.config.Retention)
+	return nil
 }
 
 // Wait blocks until the currently scheduled work has completed.
 // This happens when all tasks have scheduled and completed, the final output
-// have been computed, and all workers have been shut down.
-func (mr *Master) Wait() {
+// have been computed, and all workers have been shut down. It returns the
+// error that failed the job started by Sequential or Distributed, if any.
+func (mr *Master) Wait() error {
 	<-mr.doneChannel
+	if mr.single == nil {
+		return nil
+	}
+	return mr.single.err
 }
 
-// killWorkers cleans up all workers by sending each one a Shutdown RPC.
-// It also collects and returns the number of tasks each worker has performed.
+// killWorkers cleans up all workers that are not dead by sending each one a
+// Shutdown RPC. It also collects and returns the number of tasks each worker
+// has performed.
 func (mr *Master) killWorkers() []int {
 	mr.Lock()
 	defer mr.Unlock()
 	ntasks := make([]int, 0, len(mr.workers))
 	for _, w := range mr.workers {
+		if mr.stateLocked(w) == WorkerDead {
+			debug("Master: skip shutdown of dead worker %s\n", w)
+			continue
+		}
 		debug("Master: shutdown worker %s\n", w)
 		var reply ShutdownReply
-		ok := call(w, "Worker.Shutdown", new(struct{}), &reply)
+		ok := mr.clients.call(w, "Worker.Shutdown", new(struct{}), &reply)
 		if !ok {
 			fmt.Printf("Master: RPC %s shutdown error\n", w)
 		} else {
 			ntasks = append(ntasks, reply.Ntasks)
+			for i, slot := range reply.Slots {
+				debug("Master: worker %s slot %d ran %d tasks in %v\n", w, i, slot.Tasks, slot.Busy)
+			}
 		}
 	}
 	return ntasks
 }
-
-
-
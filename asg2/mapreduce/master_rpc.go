@@ -3,9 +3,7 @@ package mapreduce
 import (
 	"fmt"
 	"log"
-	"net"
 	"net/rpc"
-	"os"
 )
 
 // Shutdown is an RPC method that shuts down the Master's RPC server.
@@ -16,17 +14,30 @@ func (mr *Master) Shutdown(_, _ *struct{}) error {
 	return nil
 }
 
+// masterServer exports the RPC methods of a Master. It only exists so that
+// the Status RPC can share its name with the Master.Status method.
+type masterServer struct {
+	*Master
+}
+
+// Status is an RPC method that reports the state of the master's workers and
+// the progress of its jobs.
+func (s masterServer) Status(_ *struct{}, reply *StatusReply) error {
+	*reply = s.Master.Status()
+	return nil
+}
+
 // startRPCServer staarts the Master's RPC server. It continues accepting RPC
 // calls (Register in particular) for as long as the worker is alive.
 func (mr *Master) startRPCServer() {
 	rpcs := rpc.NewServer()
-	rpcs.Register(mr)
-	os.Remove(mr.address) // only needed for "unix"
-	l, e := net.Listen("unix", mr.address)
+	rpcs.RegisterName("Master", masterServer{mr})
+	l, address, e := listen(mr.address)
 	if e != nil {
 		log.Fatal("RegstrationServer", mr.address, " error: ", e)
 	}
 	mr.l = l
+	mr.address = address
 
 	// now that we are listening on the master address, can fork off
 	// accepting connections to another thread.
@@ -64,3 +75,16 @@ func (mr *Master) stopRPCServer() {
 	}
 	debug("cleanupRegistration: done\n")
 }
+
+// RequestStatus asks the master at the given address for the state of its
+// workers and jobs, as the Status method reports them.
+func RequestStatus(master string) (StatusReply, error) {
+	var reply StatusReply
+	err := invoke(master, "Master.Status", new(struct{}), &reply)
+	return reply, err
+}
+
+// RequestCancel asks the master at the given address to cancel the named job.
+func RequestCancel(master string, jobName string) error {
+	return invoke(master, "Master.Cancel", &JobArgs{JobName: jobName}, new(struct{}))
+}
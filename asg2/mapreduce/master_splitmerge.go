@@ -2,51 +2,128 @@ package mapreduce
 
 import (
 	"bufio"
-	"encoding/json"
+	"container/heap"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"sort"
 )
 
-// merge combines the results of the many reduce jobs into a single output file
-func (mr *Master) merge() {
+// merge combines the results of the many reduce jobs into a single output file,
+// sorted in the job's key order. Every reducer output is sorted in that order
+// already, so they are merged as the runs of a reduce task are, holding only
+// one record of each in memory. Should several reducer outputs hold the same
+// key, the record of the last one is kept.
+func (j *job) merge() error {
 	debug("Merge phase")
-	kvs := make(map[string]string)
-	for i := 0; i < mr.nReduce; i++ {
-		p := getReduceOutName(mr.jobName, i)
-		debug("Merge: read %s\n", p)
-		file, err := os.Open(p)
+	// A RangePartitioner splits the keys in string order, so its reducer
+	// outputs only follow each other in a job without a key order.
+	if _, ok := j.config.Options.Partitioner.(*RangePartitioner); ok && j.config.Options.KeyOrder == "" {
+		return j.concat()
+	}
+	readers := make([]*runReader, 0, j.config.NReduce)
+	runs := runHeap{less: keyLess(j.config.Options)}
+	for i := 0; i < j.config.NReduce; i++ {
+		in, decoder, err := j.openReduceOut(i)
 		if err != nil {
-			log.Fatal("Merge: ", err)
+			return err
 		}
-		dec := json.NewDecoder(file)
-		for {
-			var kv KeyValue
-			err = dec.Decode(&kv)
-			if err != nil {
-				break
-			}
-			kvs[kv.Key] = kv.Value
+		defer in.Close()
+		run := &runReader{index: i, decoder: decoder}
+		readers = append(readers, run)
+		if run.advance() {
+			runs.runs = append(runs.runs, run)
+		}
+	}
+	heap.Init(&runs)
+
+	file, err := os.Create(getMergeName(j.config.OutputDir, j.jobName))
+	if err != nil {
+		return fmt.Errorf("merge: %v", err)
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	var last *KeyValue // written once the next key differs
+	for runs.Len() > 0 {
+		run := runs.runs[0]
+		if last != nil && last.Key != run.head.Key {
+			fmt.Fprintf(w, "%s: %s\n", last.Key, last.Value)
+		}
+		kv := run.head
+		last = &kv
+		if run.advance() {
+			heap.Fix(&runs, 0)
+		} else {
+			heap.Pop(&runs)
 		}
-		file.Close()
 	}
-	var keys []string
-	for k := range kvs {
-		keys = append(keys, k)
+	if last != nil {
+		fmt.Fprintf(w, "%s: %s\n", last.Key, last.Value)
 	}
-	sort.Strings(keys)
+	for i, run := range readers {
+		if run.err != nil {
+			return fmt.Errorf("merge: %s: %v", getReduceOutName(j.config.WorkDir, j.jobName, i), run.err)
+		}
+	}
+	return w.Flush()
+}
 
-	file, err := os.Create("mrtmp." + mr.jobName)
+// concat merges reducer outputs whose key ranges do not overlap and follow the
+// order of the reduce tasks, as produced by a RangePartitioner, by writing them
+// out one after the other.
+func (j *job) concat() error {
+	file, err := os.Create(getMergeName(j.config.OutputDir, j.jobName))
 	if err != nil {
-		log.Fatal("Merge: create ", err)
+		return fmt.Errorf("merge: %v", err)
 	}
+	defer file.Close()
 	w := bufio.NewWriter(file)
-	for _, k := range keys {
-		fmt.Fprintf(w, "%s: %s\n", k, kvs[k])
+	for i := 0; i < j.config.NReduce; i++ {
+		err := j.readReduceOut(i, func(kv KeyValue) {
+			fmt.Fprintf(w, "%s: %s\n", kv.Key, kv.Value)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// openReduceOut opens a reducer output file for reading its records.
+func (j *job) openReduceOut(reduceTask int) (*os.File, RecordDecoder, error) {
+	p := getReduceOutName(j.config.WorkDir, j.jobName, reduceTask)
+	debug("Merge: read %s\n", p)
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, nil, fmt.Errorf("merge: %v", err)
+	}
+	dec, err := newRecordReader(file, j.config.Options)
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("merge: %v", err)
+	}
+	return file, dec, nil
+}
+
+// readReduceOut passes the records of a reducer output file to f in order.
+func (j *job) readReduceOut(reduceTask int, f func(kv KeyValue)) error {
+	file, dec, err := j.openReduceOut(reduceTask)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	p := file.Name()
+	for {
+		var kv KeyValue
+		err = dec.Decode(&kv)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("merge: %s: %v", p, err)
+		}
+		f(kv)
 	}
-	w.Flush()
-	file.Close()
 }
 
 // removeFile is a simple wrapper around os.Remove that logs errors.
@@ -57,15 +134,68 @@ func removeFile(n string) {
 	}
 }
 
-// CleanupFiles removes all intermediate files produced by running mapreduce.
+// intermediateFiles lists the map outputs of a job, which are only in its work
+// directory if they are not shuffled between workers.
+func (j *job) intermediateFiles() []string {
+	if j.config.Options.LocalShuffle {
+		return nil
+	}
+	var names []string
+	for m := range j.splits {
+		for r := 0; r < j.config.NReduce; r++ {
+			names = append(names, getIntermediateName(j.config.WorkDir, j.jobName, m, r))
+		}
+	}
+	return names
+}
+
+// workFiles lists the files a job keeps in its work directory besides the map
+// outputs, ending with the directory itself.
+func (j *job) workFiles() []string {
+	var names []string
+	for i := 0; i < j.config.NReduce; i++ {
+		names = append(names, getReduceOutName(j.config.WorkDir, j.jobName, i))
+	}
+	return append(names, getJournalName(j.config.WorkDir, j.jobName), getJobDir(j.config.WorkDir, j.jobName))
+}
+
+// discardOutputs removes the files of a completed job that the given retention
+// policy does not keep.
+func (j *job) discardOutputs(retention Retention) {
+	var names []string
+	if retention >= KeepReduceOutput {
+		names = append(names, j.intermediateFiles()...)
+	}
+	if retention >= KeepMergedOutput {
+		names = append(names, j.workFiles()...)
+	}
+	for _, n := range names {
+		err := os.Remove(n)
+		if err != nil {
+			debug("discardOutputs: %v\n", err)
+		}
+	}
+}
+
+// CleanupFiles removes all files produced by running the job started by
+// Sequential or Distributed, or the last stage of a pipeline, that its
+// retention policy kept.
 func (mr *Master) CleanupFiles() {
-	for i := range mr.files {
-		for j := 0; j < mr.nReduce; j++ {
-			removeFile(getIntermediateName(mr.jobName, i, j))
+	if mr.single != nil {
+		mr.single.cleanupFiles()
+	}
+}
+
+func (j *job) cleanupFiles() {
+	if j.config.Retention < KeepReduceOutput {
+		for _, n := range j.intermediateFiles() {
+			removeFile(n)
 		}
 	}
-	for i := 0; i < mr.nReduce; i++ {
-		removeFile(getReduceOutName(mr.jobName, i))
+	if j.config.Retention < KeepMergedOutput {
+		for _, n := range j.workFiles() {
+			removeFile(n)
+		}
 	}
-	removeFile("mrtmp." + mr.jobName)
+	removeFile(getMergeName(j.config.OutputDir, j.jobName))
 }
@@ -0,0 +1,98 @@
+package mapreduce
+
+import (
+	"time"
+)
+
+// Workers send a heartbeat to the master every heartbeatInterval. A worker the
+// master has not heard from for suspectTimeout is suspect, and after
+// deadTimeout it is considered dead: its running tasks are rescheduled and it
+// is no longer given work or sent a Shutdown.
+var (
+	heartbeatInterval = 500 * time.Millisecond
+	suspectTimeout    = 2 * time.Second
+	deadTimeout       = 5 * time.Second
+)
+
+// WorkerState describes whether the master believes a worker is alive.
+type WorkerState string
+
+const (
+	WorkerAlive   WorkerState = "alive"
+	WorkerSuspect WorkerState = "suspect"
+	WorkerDead    WorkerState = "dead"
+)
+
+// Heartbeat is an RPC method that workers call periodically to report that
+// they are alive, along with the progress of the tasks they are running. A
+// worker the master does not know about, e.g. because the master was
+// restarted, is told to register again, and so is one it had declared dead:
+// the scheduler dropped its slots, and registering puts them back.
+func (mr *Master) Heartbeat(args *HeartbeatArgs, reply *HeartbeatReply) error {
+	mr.Lock()
+	defer mr.Unlock()
+	_, known := mr.lastHeartbeat[args.Worker]
+	reply.Registered = known && mr.stateLocked(args.Worker) != WorkerDead
+	if reply.Registered {
+		mr.lastHeartbeat[args.Worker] = time.Now()
+		mr.workerTasks[args.Worker] = args.Tasks
+	}
+	return nil
+}
+
+// workerState tells how long ago the master last heard from a worker.
+func (mr *Master) workerState(worker string) WorkerState {
+	mr.Lock()
+	defer mr.Unlock()
+	return mr.stateLocked(worker)
+}
+
+func (mr *Master) stateLocked(worker string) WorkerState {
+	last, ok := mr.lastHeartbeat[worker]
+	silence := time.Since(last)
+	switch {
+	case !ok || silence > deadTimeout:
+		return WorkerDead
+	case silence > suspectTimeout:
+		return WorkerSuspect
+	default:
+		return WorkerAlive
+	}
+}
+
+// rejoined tells whether the worker of an attempt registered again since the
+// attempt started. The slot the attempt ran in was then put back in the pool
+// already, so the scheduler must not keep it once the attempt returns.
+func (mr *Master) rejoined(a *taskAttempt) bool {
+	mr.Lock()
+	defer mr.Unlock()
+	return mr.workerJoins[a.worker] != a.joined
+}
+
+// liveWorkers counts the registered workers that are not dead.
+func (mr *Master) liveWorkers() int {
+	mr.Lock()
+	defer mr.Unlock()
+	return mr.liveLocked()
+}
+
+func (mr *Master) liveLocked() int {
+	live := 0
+	for _, w := range mr.workers {
+		if mr.stateLocked(w) != WorkerDead {
+			live++
+		}
+	}
+	return live
+}
+
+// liveSlotsLocked counts the slots of the registered workers that are not dead.
+func (mr *Master) liveSlotsLocked() int {
+	live := 0
+	for _, w := range mr.workers {
+		if mr.stateLocked(w) != WorkerDead {
+			live += mr.workerSlots[w]
+		}
+	}
+	return live
+}
@@ -1,17 +1,27 @@
 package mapreduce
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"path/filepath"
 	"runtime"
 	"testing"
 	"time"
 	"bufio"
 	"log"
+	"net"
+	"net/rpc"
 	"os"
+	"os/exec"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 const (
@@ -24,7 +34,7 @@ const (
 // Check if we have N numbers in output file
 
 // Split in words
-func MapFunc(file string, value string) (res []KeyValue) {
+func MapFunc(file string, value string, r Reporter) (res []KeyValue) {
 	debug("Map %v\n", value)
 	words := strings.Fields(value)
 	for _, w := range words {
@@ -35,8 +45,8 @@ func MapFunc(file string, value string) (res []KeyValue) {
 }
 
 // Just return key
-func ReduceFunc(key string, values []string) string {
-	for _, e := range values {
+func ReduceFunc(key string, values ValueIterator) string {
+	for e, ok := values.Next(); ok; e, ok = values.Next() {
 		debug("Reduce %s %v\n", key, e)
 	}
 	return ""
@@ -45,7 +55,12 @@ func ReduceFunc(key string, values []string) string {
 // Checks input file agaist output file: each input number should show up
 // in the output file in string sorted order
 func check(t *testing.T, files []string) {
-	output, err := os.Open("mrtmp.test")
+	checkOutput(t, "mrtmp.test", files)
+}
+
+// checkOutput checks the merged output of a job that ran over files.
+func checkOutput(t *testing.T, outName string, files []string) {
+	output, err := os.Open(outName)
 	if err != nil {
 		log.Fatal("check: ", err)
 	}
@@ -152,59 +167,889 @@ func port(suffix string) string {
 func setup() *Master {
 	files := makeInputs(nMap)
 	master := port("master")
-	mr := Distributed("test", files, nReduce, master)
+	mr := Distributed(context.Background(), "test", JobConfig{InputDir: files, NReduce: nReduce}, master)
 	return mr
 }
 
 func cleanup(mr *Master) {
 	mr.CleanupFiles()
-	for _, f := range mr.files {
+	for _, f := range mr.single.files {
 		removeFile(f)
 	}
-	removeFile(mr.dirName)
+	removeFile(mr.single.config.InputDir)
 }
 
 func TestSequentialSingle(t *testing.T) {
-	mr := Sequential("test", makeInputs(1), 1, MapFunc, ReduceFunc)
+	mr := Sequential(context.Background(), "test", JobConfig{InputDir: makeInputs(1), NReduce: 1}, MapFunc, ReduceFunc, nil)
 	mr.Wait()
-	check(t, mr.files)
+	check(t, mr.single.files)
 	checkWorker(t, mr.stats)
 	cleanup(mr)
 }
 
 func TestSequentialMany(t *testing.T) {
-	mr := Sequential("test", makeInputs(5), 3, MapFunc, ReduceFunc)
+	mr := Sequential(context.Background(), "test", JobConfig{InputDir: makeInputs(5), NReduce: 3}, MapFunc, ReduceFunc, nil)
+	mr.Wait()
+	check(t, mr.single.files)
+	checkWorker(t, mr.stats)
+	cleanup(mr)
+}
+
+func TestSequentialCombine(t *testing.T) {
+	mr := Sequential(context.Background(), "test", JobConfig{InputDir: makeInputs(5), NReduce: 3}, MapFunc, ReduceFunc, ReduceFunc)
 	mr.Wait()
-	check(t, mr.files)
+	check(t, mr.single.files)
 	checkWorker(t, mr.stats)
 	cleanup(mr)
 }
 
+func TestSequentialRange(t *testing.T) {
+	indir := makeInputs(5)
+	sample, err := SampleKeys(indir, 1000, MapFunc)
+	checkError(err)
+	partitioner := NewRangePartitioner(sample, 3)
+	mr := Sequential(context.Background(), "test", JobConfig{InputDir: indir, NReduce: 3,
+		Options: JobOptions{Partitioner: partitioner}}, MapFunc, ReduceFunc, nil)
+	mr.Wait()
+	check(t, mr.single.files)
+	checkWorker(t, mr.stats)
+	cleanup(mr)
+}
+
+func TestSequentialCodecs(t *testing.T) {
+	// Every codec and every compression is used once.
+	for _, options := range []JobOptions{
+		{Codec: "json"},
+		{Codec: "gob", Compression: "gzip"},
+		{Codec: "binary", Compression: "flate"},
+	} {
+		config := JobConfig{InputDir: makeInputs(5), NReduce: 3, Options: options}
+		mr := Sequential(context.Background(), "test", config, MapFunc, ReduceFunc, ReduceFunc)
+		mr.Wait()
+		check(t, mr.single.files)
+		cleanup(mr)
+	}
+}
+
+func TestSequentialSplits(t *testing.T) {
+	// Each input file is cut into several splits.
+	mr := Sequential(context.Background(), "test", JobConfig{InputDir: makeInputs(5), NReduce: 3,
+		Options: JobOptions{Input: TextInput{SplitSize: 10000}}}, MapFunc, ReduceFunc, nil)
+	mr.Wait()
+	if len(mr.single.splits) <= len(mr.single.files) {
+		t.Fatalf("%d splits for %d files\n", len(mr.single.splits), len(mr.single.files))
+	}
+	check(t, mr.single.files)
+	cleanup(mr)
+
+	// All input files are packed into a single split.
+	mr = Sequential(context.Background(), "test", JobConfig{InputDir: makeInputs(nMap), NReduce: 3,
+		Options: JobOptions{Input: TextInput{SplitSize: 1 << 20}}}, MapFunc, ReduceFunc, nil)
+	mr.Wait()
+	if len(mr.single.splits) != 1 {
+		t.Fatalf("%d splits for %d files\n", len(mr.single.splits), len(mr.single.files))
+	}
+	check(t, mr.single.files)
+	cleanup(mr)
+}
+
+func TestBinaryCodecCorrupt(t *testing.T) {
+	var buf bytes.Buffer
+	binaryCodec{}.NewEncoder(&buf).Encode(KeyValue{"key", "value"})
+	record := buf.Bytes()
+	// A huge length, and a record cut short in its value.
+	huge := binary.AppendUvarint(nil, 1<<62)
+	for _, b := range [][]byte{huge, record[:len(record)-1]} {
+		var kv KeyValue
+		err := binaryCodec{}.NewDecoder(bytes.NewReader(b)).Decode(&kv)
+		if err == nil || err == io.EOF {
+			t.Fatalf("decoding %q returned %v, expected an error\n", b, err)
+		}
+	}
+}
+
+func TestRangePartitioner(t *testing.T) {
+	p := NewRangePartitioner([]string{"f", "b", "d", "h", "a", "c", "e", "g"}, 4)
+	prev := 0
+	for _, key := range []string{"", "a", "b", "c", "cz", "d", "e", "f", "g", "h", "z"} {
+		i := p.Partition(key, 4)
+		if i < prev || i >= 4 {
+			t.Fatalf("key %q in partition %d after partition %d\n", key, i, prev)
+		}
+		prev = i
+	}
+	if prev != 3 {
+		t.Fatalf("largest key in partition %d, expected 3\n", prev)
+	}
+}
+
+func TestSequentialResume(t *testing.T) {
+	indir := makeInputs(5)
+	mr := Sequential(context.Background(), "test", JobConfig{InputDir: indir, NReduce: 3}, MapFunc, ReduceFunc, nil)
+	mr.Wait()
+
+	// The job completed, so running it again starts it over.
+	header := journalHeader{"test", jobFingerprint(mr.single.splits, 3, JobOptions{})}
+	if _, ok := readJournal(getJournalName(defaultWorkDir, "test"), header); ok {
+		t.Fatalf("journal of a completed job can be resumed\n")
+	}
+
+	// Pretend the master crashed during the reduce phase: the journal only
+	// holds the map tasks and the reducer outputs are gone.
+	committed := make(map[taskID]journalEntry)
+	for i := range mr.single.splits {
+		committed[taskID{mapPhase, i}] = journalEntry{Phase: mapPhase, Task: i}
+	}
+	for i := 0; i < 3; i++ {
+		removeFile(getReduceOutName(defaultWorkDir, "test", i))
+	}
+	j, err := openJournal(getJournalName(defaultWorkDir, "test"), header, committed)
+	checkError(err)
+	j.close()
+
+	mapF := func(file string, value string, r Reporter) []KeyValue {
+		t.Errorf("map task on %s ran again\n", file)
+		return nil
+	}
+	mr = Sequential(context.Background(), "test", JobConfig{InputDir: indir, NReduce: 3}, mapF, ReduceFunc, nil)
+	mr.Wait()
+	check(t, mr.single.files)
+	cleanup(mr)
+}
+
+func TestSequentialRerun(t *testing.T) {
+	indir := makeInputs(5)
+	mr := Sequential(context.Background(), "test", JobConfig{InputDir: indir, NReduce: 3}, MapFunc, ReduceFunc, nil)
+	mr.Wait()
+	fingerprint := jobFingerprint(mr.single.splits, 3, JobOptions{})
+
+	// A completed job runs all its tasks again, with the new reducer.
+	reduceF := func(key string, values ValueIterator) string {
+		return "again"
+	}
+	mr = Sequential(context.Background(), "test", JobConfig{InputDir: indir, NReduce: 3}, MapFunc, reduceF, nil)
+	mr.Wait()
+	contents, err := os.ReadFile("mrtmp.test")
+	checkError(err)
+	if !strings.Contains(string(contents), ": again") {
+		t.Fatalf("rerun merged the output of the first run\n")
+	}
+
+	// Changing an input changes the fingerprint of the job.
+	file, err := os.OpenFile(mr.single.files[0], os.O_APPEND|os.O_WRONLY, 0)
+	checkError(err)
+	fmt.Fprintf(file, "%d\n", nNumber)
+	file.Close()
+	if jobFingerprint(mr.single.splits, 3, JobOptions{}) == fingerprint {
+		t.Fatalf("fingerprint unchanged by a changed input\n")
+	}
+	cleanup(mr)
+}
+
+func TestSequentialConfig(t *testing.T) {
+	indir := makeInputs(5)
+	files, err := getChildrenFiles(indir)
+	checkError(err)
+	workDir, outDir := t.TempDir(), t.TempDir()
+
+	// Two jobs sharing their directories run side by side.
+	config := JobConfig{InputDir: indir, WorkDir: workDir, OutputDir: outDir, NReduce: 3}
+	config.Retention = KeepMergedOutput
+	mrA := Sequential(context.Background(), "test-a", config, MapFunc, ReduceFunc, nil)
+	config.Retention = KeepReduceOutput
+	mrB := Sequential(context.Background(), "test-b", config, MapFunc, ReduceFunc, nil)
+	mrA.Wait()
+	mrB.Wait()
+	checkOutput(t, filepath.Join(outDir, "mrtmp.test-a"), files)
+	checkOutput(t, filepath.Join(outDir, "mrtmp.test-b"), files)
+
+	if _, err := os.Stat(getJobDir(workDir, "test-a")); err == nil {
+		t.Fatalf("work directory of test-a was kept\n")
+	}
+	if _, err := os.Stat(getIntermediateName(workDir, "test-b", 0, 0)); err == nil {
+		t.Fatalf("map output of test-b was kept\n")
+	}
+	if _, err := os.Stat(getReduceOutName(workDir, "test-b", 0)); err != nil {
+		t.Fatalf("reducer output of test-b was removed: %v\n", err)
+	}
+	mrA.CleanupFiles()
+	mrB.CleanupFiles()
+	os.RemoveAll(indir)
+}
+
+func TestPipeline(t *testing.T) {
+	indir := makeInputs(5)
+	count := func(key string, values ValueIterator) string {
+		n := 0
+		for _, ok := values.Next(); ok; _, ok = values.Next() {
+			n++
+		}
+		return strconv.Itoa(n)
+	}
+	// The second stage sees the counts computed by the first.
+	identity := func(key string, value string, r Reporter) []KeyValue {
+		if value != "1" {
+			t.Errorf("key %s counted %s times\n", key, value)
+		}
+		r.AddCounter("records", 1)
+		return []KeyValue{{key, value}}
+	}
+	stages := []Stage{
+		{Name: "test-count", Map: MapFunc, Reduce: count, Config: JobConfig{InputDir: indir, NReduce: 3,
+			Options: JobOptions{Codec: "binary", Compression: "gzip"}}},
+		{Name: "test", Map: identity, Reduce: ReduceFunc, Config: JobConfig{NReduce: 2}},
+	}
+	files, err := getChildrenFiles(indir)
+	checkError(err)
+	for _, distributed := range []bool{false, true} {
+		var mr *Master
+		if distributed {
+			mr = DistributedPipeline(context.Background(), stages, port("master"))
+			for i := 0; i < 2; i++ {
+				go RunPipelineWorker(mr.address, port("worker"+strconv.Itoa(i)), stages, nil, 1, -1, false)
+			}
+		} else {
+			mr = SequentialPipeline(context.Background(), stages)
+		}
+		if err := mr.Wait(); err != nil {
+			t.Fatalf("pipeline failed (distributed: %v): %v\n", distributed, err)
+		}
+		for _, j := range mr.Status().Jobs {
+			if n := j.Stats.Counters["records"]; j.JobName == "test" && n != nNumber {
+				t.Fatalf("second stage mapped %d records, expected %d\n", n, nNumber)
+			}
+		}
+		check(t, files)
+		if distributed {
+			checkWorker(t, mr.stats)
+		}
+		mr.CleanupFiles()
+		os.Remove("mrtmp.test-count")
+		os.RemoveAll(getJobDir(defaultWorkDir, "test-count"))
+	}
+	os.RemoveAll(indir)
+}
+
+func TestPipelineCancel(t *testing.T) {
+	// The first stage is cancelled before it completes, and the second
+	// one does not run.
+	indir := makeInputs(5)
+	defer os.RemoveAll(indir)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelMapFunc := func(file string, value string, r Reporter) []KeyValue {
+		cancel()
+		return MapFunc(file, value, r)
+	}
+	mr := SequentialPipeline(ctx, []Stage{
+		{Name: "test-first", Map: cancelMapFunc, Reduce: ReduceFunc, Config: JobConfig{InputDir: indir, NReduce: 3}},
+		{Name: "test", Map: MapFunc, Reduce: ReduceFunc, Config: JobConfig{NReduce: 2}},
+	})
+	if err := mr.Wait(); !errors.Is(err, ErrCancelled) {
+		t.Fatalf("pipeline failed with %v, expected it to be cancelled\n", err)
+	}
+	if mr.single.jobName != "test-first" {
+		t.Fatalf("stage %s ran after the first one was cancelled\n", mr.single.jobName)
+	}
+	os.RemoveAll(getJobDir(defaultWorkDir, "test-first"))
+}
+
+func TestMergeReduceOutputs(t *testing.T) {
+	// The reducer outputs interleave, and two of them hold key "c".
+	outputs := [][]KeyValue{
+		{{"a", "1"}, {"c", "first"}, {"e", "5"}},
+		{{"b", "2"}, {"d", "4"}},
+		{{"c", "last"}, {"f", "6"}},
+	}
+	j := &job{jobName: "merge", config: JobConfig{NReduce: len(outputs), WorkDir: t.TempDir(), OutputDir: t.TempDir()}}
+	checkError(os.MkdirAll(getJobDir(j.config.WorkDir, "merge"), 0755))
+	for i, kvs := range outputs {
+		file, err := os.Create(getReduceOutName(j.config.WorkDir, "merge", i))
+		checkError(err)
+		w, err := newRecordWriter(file, j.config.Options)
+		checkError(err)
+		for _, kv := range kvs {
+			checkError(w.Encode(kv))
+		}
+		checkError(w.Close())
+		file.Close()
+	}
+	checkError(j.merge())
+	output, err := os.ReadFile(getMergeName(j.config.OutputDir, "merge"))
+	checkError(err)
+	if want := "a: 1\nb: 2\nc: last\nd: 4\ne: 5\nf: 6\n"; string(output) != want {
+		t.Fatalf("merged output %q, expected %q\n", output, want)
+	}
+}
+
+func TestCommitAttempt(t *testing.T) {
+	indir := makeInputs(1)
+	os.RemoveAll(defaultWorkDir)
+	checkError(os.MkdirAll(getJobDir(defaultWorkDir, "commit"), 0755))
+	defer os.RemoveAll(defaultWorkDir)
+	defer os.RemoveAll(indir)
+
+	j := &job{jobName: "commit", config: JobConfig{NReduce: 2}.withDefaults()}
+	files, err := getChildrenFiles(indir)
+	checkError(err)
+	j.splits, _ = getSplits(files, nil)
+	j.journal, err = openJournal(getJournalName(defaultWorkDir, "commit"), journalHeader{}, nil)
+	checkError(err)
+	defer j.journal.close()
+
+	// Attempt 0 crashed after writing part of its output, attempt 1 succeeded.
+	checkError(os.WriteFile(getAttemptName(getIntermediateName(defaultWorkDir, "commit", 0, 0), 0), []byte("{\"Ke"), 0644))
+	runMapTask(context.Background(), "commit", defaultWorkDir, 0, 1, j.splits[0], j.config.NReduce, MapFunc, nil, nil, JobOptions{}, nil)
+	checkError(j.commitTask(mapPhase, 0, 1, ""))
+	j.discardAttempt(mapPhase, 0, 0)
+
+	for i := 0; i < j.config.NReduce; i++ {
+		name := getIntermediateName(defaultWorkDir, "commit", 0, i)
+		if _, err := os.Stat(name); err != nil {
+			t.Fatalf("committed output missing: %v\n", err)
+		}
+		for attempt := 0; attempt < 2; attempt++ {
+			if _, err := os.Stat(getAttemptName(name, attempt)); err == nil {
+				t.Fatalf("%s left behind\n", getAttemptName(name, attempt))
+			}
+		}
+	}
+	if attempt := j.journal.committed[taskID{mapPhase, 0}].Attempt; attempt != 1 {
+		t.Fatalf("journal committed attempt %d, expected 1\n", attempt)
+	}
+}
+
+func TestCombine(t *testing.T) {
+	kvs := []KeyValue{{"b", "1"}, {"a", "1"}, {"b", "1"}, {"c", "1"}, {"b", "1"}}
+	count := func(key string, values ValueIterator) string {
+		n := 0
+		for _, ok := values.Next(); ok; _, ok = values.Next() {
+			n++
+		}
+		return strconv.Itoa(n)
+	}
+	got := combine(kvs, keyLess(JobOptions{}), nil, count)
+	want := []KeyValue{{"a", "1"}, {"b", "3"}, {"c", "1"}}
+	if len(got) != len(want) {
+		t.Fatalf("combine: got %v, want %v\n", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("combine: got %v, want %v\n", got, want)
+		}
+	}
+}
+
+func TestReduceMergesRuns(t *testing.T) {
+	runs := [][]KeyValue{
+		{{"a", "0"}, {"b", "0"}, {"b", "1"}, {"d", "0"}},
+		{},
+		{{"b", "2"}, {"c", "2"}, {"d", "2"}},
+	}
+	os.RemoveAll(defaultWorkDir)
+	checkError(os.MkdirAll(getJobDir(defaultWorkDir, "merge"), 0755))
+	defer os.RemoveAll(defaultWorkDir)
+	for i, run := range runs {
+		file, err := os.Create(getIntermediateName(defaultWorkDir, "merge", i, 0))
+		checkError(err)
+		enc := json.NewEncoder(file)
+		for _, kv := range run {
+			checkError(enc.Encode(kv))
+		}
+		file.Close()
+	}
+
+	// The reducer joins at most two values, leaving the rest unread.
+	runReduceTask(context.Background(), "merge", defaultWorkDir, 0, 0, len(runs), func(key string, values ValueIterator) string {
+		var read []string
+		for v, ok := values.Next(); ok && len(read) < 2; v, ok = values.Next() {
+			read = append(read, v)
+		}
+		return strings.Join(read, ",")
+	}, nil, JobOptions{}, nil, nil, nil)
+
+	file, err := os.Open(getAttemptName(getReduceOutName(defaultWorkDir, "merge", 0), 0))
+	checkError(err)
+	defer file.Close()
+	want := []KeyValue{{"a", "0"}, {"b", "0,1"}, {"c", "2"}, {"d", "0,2"}}
+	dec := json.NewDecoder(file)
+	for _, w := range want {
+		var kv KeyValue
+		if err := dec.Decode(&kv); err != nil || kv != w {
+			t.Fatalf("got %v (err %v), want %v\n", kv, err, w)
+		}
+	}
+}
+
 func TestBasic(t *testing.T) {
 	mr := setup()
 	for i := 0; i < 2; i++ {
 		go RunWorker(mr.address, port("worker"+strconv.Itoa(i)),
-			MapFunc, ReduceFunc, -1, false)
+			MapFunc, ReduceFunc, nil, nil, 1, -1, false)
+	}
+	mr.Wait()
+	check(t, mr.single.files)
+	checkWorker(t, mr.stats)
+	cleanup(mr)
+}
+
+func TestBasicRange(t *testing.T) {
+	indir := makeInputs(nMap)
+	sample, err := SampleKeys(indir, 1000, MapFunc)
+	checkError(err)
+	partitioner := NewRangePartitioner(sample, nReduce)
+	mr := Distributed(context.Background(), "test", JobConfig{InputDir: indir, NReduce: nReduce,
+		Options: JobOptions{Partitioner: partitioner}}, port("master"))
+	for i := 0; i < 2; i++ {
+		go RunWorker(mr.address, port("worker"+strconv.Itoa(i)),
+			MapFunc, ReduceFunc, nil, nil, 1, -1, false)
+	}
+	mr.Wait()
+	check(t, mr.single.files)
+	checkWorker(t, mr.stats)
+	cleanup(mr)
+}
+
+func TestBasicOptions(t *testing.T) {
+	// Splits pack several input files, and cut some of them in two.
+	options := JobOptions{Combine: true, Codec: "binary", Compression: "gzip",
+		Input: TextInput{SplitSize: 64 << 10}}
+	mr := Distributed(context.Background(), "test", JobConfig{InputDir: makeInputs(nMap), NReduce: nReduce, Options: options}, port("master"))
+	for i := 0; i < 2; i++ {
+		go RunWorker(mr.address, port("worker"+strconv.Itoa(i)),
+			MapFunc, ReduceFunc, ReduceFunc, nil, 1, -1, false)
+	}
+	mr.Wait()
+	check(t, mr.single.files)
+	checkWorker(t, mr.stats)
+	cleanup(mr)
+}
+
+// TestWorkerProcess is not a test of its own: TestTCPMultiProcess starts the
+// test binary with it to run workers in separate processes.
+func TestWorkerProcess(t *testing.T) {
+	master := os.Getenv("MR_TEST_MASTER")
+	if master == "" {
+		t.Skip("only run as a worker process by TestTCPMultiProcess")
+	}
+	RunWorker(master, "tcp://127.0.0.1:0", MapFunc, ReduceFunc, nil, nil, 1, -1, true)
+}
+
+func TestTCPMultiProcess(t *testing.T) {
+	mr := Distributed(context.Background(), "test", JobConfig{InputDir: makeInputs(nMap), NReduce: nReduce}, "tcp://127.0.0.1:0")
+	for i := 0; i < 2; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestWorkerProcess$")
+		cmd.Env = append(os.Environ(), "MR_TEST_MASTER="+mr.address)
+		checkError(cmd.Start())
+		defer cmd.Wait()
 	}
 	mr.Wait()
-	check(t, mr.files)
+	check(t, mr.single.files)
 	checkWorker(t, mr.stats)
 	cleanup(mr)
 }
 
+func TestParseAddress(t *testing.T) {
+	for _, c := range []struct{ addr, network, address string }{
+		{"/var/tmp/552-mr", "unix", "/var/tmp/552-mr"},
+		{"localhost_7777", "unix", "localhost_7777"},
+		{"unix:///var/tmp/552-mr", "unix", "/var/tmp/552-mr"},
+		{"tcp://127.0.0.1:7777", "tcp", "127.0.0.1:7777"},
+	} {
+		network, address := parseAddress(c.addr)
+		if network != c.network || address != c.address {
+			t.Fatalf("parseAddress(%q) = %q, %q\n", c.addr, network, address)
+		}
+	}
+}
+
+func TestListenTCP(t *testing.T) {
+	// The port the system picks is filled in; a host listening on all
+	// interfaces is kept, and cannot be a worker's address.
+	l, address, err := listen("tcp://:0")
+	checkError(err)
+	l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	if address != "tcp://:"+port {
+		t.Fatalf("listening on tcp://:0 gave address %s, expected tcp://:%s\n", address, port)
+	}
+	for _, addr := range []string{address, "tcp://0.0.0.0:7778", "tcp://[::]:7778"} {
+		if checkWorkerAddress(addr) == nil {
+			t.Fatalf("worker address %s accepted\n", addr)
+		}
+	}
+
+	// A worker registers the host it was given, with its port.
+	mr := StartMaster("tcp://127.0.0.1:0")
+	go RunWorker(mr.address, "tcp://127.0.0.1:0", MapFunc, ReduceFunc, nil, nil, 1, -1, false)
+	for len(mr.Status().Workers) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	reply := mr.Status()
+	if len(reply.Workers) != 1 || !strings.HasPrefix(reply.Workers[0].Worker, "tcp://127.0.0.1:") || strings.HasSuffix(reply.Workers[0].Worker, ":0") {
+		t.Fatalf("Status reports workers %v, expected one at tcp://127.0.0.1\n", reply.Workers)
+	}
+	mr.Stop()
+	mr.Wait()
+}
+
 func TestOneFailure(t *testing.T) {
 	mr := setup()
 	// Run 2 workers. The first worker will fail after 10 tasks
 	go RunWorker(mr.address, port("worker"+strconv.Itoa(0)),
-		MapFunc, ReduceFunc, 10, false)
+		MapFunc, ReduceFunc, nil, nil, 1, 10, false)
 	go RunWorker(mr.address, port("worker"+strconv.Itoa(1)),
-		MapFunc, ReduceFunc, -1, false)
+		MapFunc, ReduceFunc, nil, nil, 1, -1, false)
 	mr.Wait()
-	check(t, mr.files)
+	check(t, mr.single.files)
 	checkWorker(t, mr.stats)
 	cleanup(mr)
 }
 
+// A worker whose map function never returns, simulating a hung process.
+func hungMapFunc(file string, value string, r Reporter) []KeyValue {
+	select {}
+}
+
+// panicMapFunc panics on the first input file.
+func panicMapFunc(file string, value string, r Reporter) []KeyValue {
+	if strings.HasSuffix(file, "mrinput-0.txt") {
+		panic("bad record in " + file)
+	}
+	return MapFunc(file, value, r)
+}
+
+func TestSequentialTaskError(t *testing.T) {
+	mr := Sequential(context.Background(), "test", JobConfig{InputDir: makeInputs(5), NReduce: 3}, panicMapFunc, ReduceFunc, nil)
+	err := mr.Wait()
+	te, ok := err.(*TaskError)
+	if !ok || te.Kind != TaskPanic || te.Phase != mapPhase || te.Task != 0 {
+		t.Fatalf("job failed with %v, expected a panic in map task 0\n", err)
+	}
+	os.RemoveAll(getJobDir(defaultWorkDir, "test"))
+	os.RemoveAll(mr.single.config.InputDir)
+}
+
+func TestSequentialInvalidConfig(t *testing.T) {
+	mr := Sequential(context.Background(), "test", JobConfig{InputDir: "tmp_testin552/missing", NReduce: 3}, MapFunc, ReduceFunc, nil)
+	if err := mr.Wait(); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("job failed with %v, expected a missing input directory\n", err)
+	}
+	mr = Sequential(context.Background(), "test", JobConfig{InputDir: makeInputs(1), NReduce: 0}, MapFunc, ReduceFunc, nil)
+	if err := mr.Wait(); err == nil {
+		t.Fatalf("job without reduce tasks did not fail\n")
+	}
+	os.RemoveAll(mr.single.config.InputDir)
+	mr = SequentialPipeline(context.Background(), nil)
+	if err := mr.Wait(); err == nil {
+		t.Fatalf("pipeline without stages did not fail\n")
+	}
+	mr = DistributedPipeline(context.Background(), nil, port("master"))
+	if err := mr.Wait(); err == nil {
+		t.Fatalf("distributed pipeline without stages did not fail\n")
+	}
+}
+
+func TestTaskErrorInputMissing(t *testing.T) {
+	split := InputSplit{Ranges: []FileRange{{File: "tmp_testin552/missing", Length: 1}}}
+	err := runMapTask(context.Background(), "test", defaultWorkDir, 0, 0, split, 1, MapFunc, nil, nil, JobOptions{}, nil)
+	te, ok := err.(*TaskError)
+	if !ok || te.Kind != TaskInputMissing {
+		t.Fatalf("map task failed with %v, expected missing input\n", err)
+	}
+	if retryTask(te, 1) {
+		t.Fatalf("retrying a map task whose input is missing\n")
+	}
+}
+
+func TestTaskErrorOutputMissing(t *testing.T) {
+	// The input exists, but the directory the output goes to does not.
+	input := makeInputs(1)
+	defer os.RemoveAll(input)
+	files, err := getChildrenFiles(input)
+	checkError(err)
+	split := InputSplit{Ranges: []FileRange{{File: files[0], Length: 1}}}
+	err = runMapTask(context.Background(), "test", "tmp_testin552/missing", 0, 0, split, 1, MapFunc, nil, nil, JobOptions{}, nil)
+	te, ok := err.(*TaskError)
+	if !ok || te.Kind != TaskIOError {
+		t.Fatalf("map task failed with %v, expected an I/O error\n", err)
+	}
+	if !retryTask(te, 1) {
+		t.Fatalf("not retrying a map task whose output directory vanished\n")
+	}
+}
+
+func TestTaskErrorRetry(t *testing.T) {
+	mr := setup()
+	// The first worker panics on one input file; the task is retried on
+	// the second one, and neither process dies.
+	go RunWorker(mr.address, port("worker"+strconv.Itoa(0)),
+		panicMapFunc, ReduceFunc, nil, nil, 1, -1, false)
+	go RunWorker(mr.address, port("worker"+strconv.Itoa(1)),
+		MapFunc, ReduceFunc, nil, nil, 1, -1, false)
+	err := mr.Wait()
+	if err != nil {
+		t.Fatalf("job failed: %v\n", err)
+	}
+	check(t, mr.single.files)
+	if len(mr.stats) != 2 {
+		t.Fatalf("%d workers left to shut down, expected 2\n", len(mr.stats))
+	}
+	cleanup(mr)
+}
+
+func TestTaskErrorFailsJob(t *testing.T) {
+	mr := setup()
+	for i := 0; i < 2; i++ {
+		go RunWorker(mr.address, port("worker"+strconv.Itoa(i)),
+			panicMapFunc, ReduceFunc, nil, nil, 1, -1, false)
+	}
+	err := mr.Wait()
+	te, ok := err.(*TaskError)
+	if !ok || te.Kind != TaskPanic || te.Task != 0 {
+		t.Fatalf("job failed with %v, expected a panic in map task 0\n", err)
+	}
+	os.RemoveAll(getJobDir(defaultWorkDir, "test"))
+	os.RemoveAll(mr.single.config.InputDir)
+}
+
+// countLines returns the number of lines in a job's merged output, and
+// whether it includes the given key.
+func countLines(outName string, key string) (int, bool) {
+	data, err := os.ReadFile(outName)
+	checkError(err)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	found := false
+	for _, line := range lines {
+		if strings.HasPrefix(line, key+": ") {
+			found = true
+		}
+	}
+	return len(lines), found
+}
+
+func TestSequentialSkipBadRecords(t *testing.T) {
+	reduceF := func(key string, values ValueIterator) string {
+		if key == "77777" {
+			panic("bad key")
+		}
+		return ReduceFunc(key, values)
+	}
+	config := JobConfig{InputDir: makeInputs(5), NReduce: 3, SkipBadRecords: 2}
+	mr := Sequential(context.Background(), "test", config, panicMapFunc, reduceF, nil)
+	err := mr.Wait()
+	if err != nil {
+		t.Fatalf("job failed: %v\n", err)
+	}
+	// The first of the five input files and key 77777 are left out.
+	n, found := countLines("mrtmp.test", "77777")
+	if n != nNumber-nNumber/5-1 || found {
+		t.Fatalf("%d lines in output (key 77777 present: %v), expected %d\n", n, found, nNumber-nNumber/5-1)
+	}
+	cleanup(mr)
+}
+
+func TestSkipBadRecords(t *testing.T) {
+	config := JobConfig{InputDir: makeInputs(nMap), NReduce: nReduce, SkipBadRecords: 2}
+	mr := Distributed(context.Background(), "test", config, port("master"))
+	for i := 0; i < 2; i++ {
+		go RunWorker(mr.address, port("worker"+strconv.Itoa(i)),
+			panicMapFunc, ReduceFunc, nil, nil, 1, -1, false)
+	}
+	err := mr.Wait()
+	if err != nil {
+		t.Fatalf("job failed: %v\n", err)
+	}
+	if n, _ := countLines("mrtmp.test", ""); n != nNumber-nNumber/nMap {
+		t.Fatalf("%d lines in output, expected %d\n", n, nNumber-nNumber/nMap)
+	}
+	cleanup(mr)
+}
+
+func TestBackupTasks(t *testing.T) {
+	defer func(threshold, timeout time.Duration) {
+		backupThreshold, taskTimeout = threshold, timeout
+	}(backupThreshold, taskTimeout)
+	backupThreshold, taskTimeout = 200*time.Millisecond, time.Hour
+
+	mr := setup()
+	go RunWorker(mr.address, port("worker"+strconv.Itoa(0)),
+		hungMapFunc, ReduceFunc, nil, nil, 1, -1, false)
+	go RunWorker(mr.address, port("worker"+strconv.Itoa(1)),
+		MapFunc, ReduceFunc, nil, nil, 1, -1, false)
+	mr.Wait()
+	check(t, mr.single.files)
+	cleanup(mr)
+}
+
+func TestTaskTimeout(t *testing.T) {
+	defer func(threshold, timeout time.Duration) {
+		backupThreshold, taskTimeout = threshold, timeout
+	}(backupThreshold, taskTimeout)
+	backupThreshold, taskTimeout = time.Hour, 500*time.Millisecond
+
+	mr := setup()
+	go RunWorker(mr.address, port("worker"+strconv.Itoa(0)),
+		hungMapFunc, ReduceFunc, nil, nil, 1, -1, false)
+	go RunWorker(mr.address, port("worker"+strconv.Itoa(1)),
+		MapFunc, ReduceFunc, nil, nil, 1, -1, false)
+	mr.Wait()
+	check(t, mr.single.files)
+	cleanup(mr)
+}
+
+func TestAbandonAttempt(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	blockedMapFunc := func(file string, value string, r Reporter) []KeyValue {
+		started <- struct{}{}
+		<-release
+		return MapFunc(file, value, r)
+	}
+	mr := StartMaster(port("master"))
+	worker := port("worker0")
+	go RunWorker(mr.address, worker, blockedMapFunc, ReduceFunc, nil, nil, 2, -1, false)
+	for len(mr.Status().Workers) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	input := makeInputs(1)
+	defer os.RemoveAll(input)
+	files, err := getChildrenFiles(input)
+	checkError(err)
+	checkError(os.MkdirAll(getJobDir(defaultWorkDir, "test"), 0755))
+	defer os.RemoveAll(getJobDir(defaultWorkDir, "test"))
+	clients := newRPCClients()
+	defer clients.close()
+	attempt := func(n int) *RunTaskArgs {
+		return &RunTaskArgs{JobName: "test", WorkDir: defaultWorkDir, Phase: mapPhase, Attempt: n, NumOtherPhase: 1,
+			Split: InputSplit{Ranges: []FileRange{{File: files[0], Length: 1}}}}
+	}
+
+	// The master stops waiting for an attempt that does not return.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if clients.callContext(ctx, worker, "Worker.RunTask", attempt(0), new(RunTaskReply)) {
+		t.Fatalf("RunTask returned from a blocked attempt\n")
+	}
+	<-started
+
+	// Only the named attempt is abandoned; it stops after its record.
+	replies := make(chan *RunTaskReply)
+	go func() {
+		reply := new(RunTaskReply)
+		clients.call(worker, "Worker.RunTask", attempt(1), reply)
+		replies <- reply
+	}()
+	<-started
+	abandon := &AttemptArgs{JobName: "test", Phase: mapPhase, Task: 0, Attempt: 1}
+	if !clients.call(worker, "Worker.AbandonAttempt", abandon, new(struct{})) {
+		t.Fatalf("AbandonAttempt failed\n")
+	}
+	close(release)
+	reply := <-replies
+	if reply.Err == nil || reply.Err.Kind != TaskAbandoned {
+		t.Fatalf("abandoned attempt returned %v\n", reply.Err)
+	}
+	if _, err := os.Stat(getAttemptName(getIntermediateName(defaultWorkDir, "test", 0, 0), 1)); err == nil {
+		t.Fatalf("abandoned attempt left its output behind\n")
+	}
+	mr.Stop()
+	mr.Wait()
+}
+
+// startSilentWorker runs a worker that registers with the master but does not
+// send heartbeats, as if it had been cut off from the master. Its heartbeats
+// start once heartbeat is called on the worker it returns.
+func startSilentWorker(master string, me string, mapF func(string, string, Reporter) []KeyValue) *Worker {
+	wk := &Worker{name: me, Map: mapF, Reduce: ReduceFunc, clients: newRPCClients(), stopHeartbeat: make(chan struct{})}
+	rpcs := rpc.NewServer()
+	rpcs.Register(wk)
+	l, _, err := listen(me)
+	checkError(err)
+	wk.l = l
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go rpcs.ServeConn(conn)
+		}
+	}()
+	checkError(wk.register(master))
+	return wk
+}
+
+func TestSilentWorker(t *testing.T) {
+	defer func(interval, suspect, dead, timeout time.Duration) {
+		heartbeatInterval, suspectTimeout, deadTimeout, taskTimeout = interval, suspect, dead, timeout
+	}(heartbeatInterval, suspectTimeout, deadTimeout, taskTimeout)
+	heartbeatInterval, suspectTimeout, deadTimeout = 50*time.Millisecond, 250*time.Millisecond, 500*time.Millisecond
+	taskTimeout = time.Hour
+
+	mr := setup()
+	silent := port("worker" + strconv.Itoa(0))
+	startSilentWorker(mr.address, silent, hungMapFunc)
+	go RunWorker(mr.address, port("worker"+strconv.Itoa(1)),
+		MapFunc, ReduceFunc, nil, nil, 1, -1, false)
+
+	// The task given to the silent worker never times out, so the job only
+	// completes if it is rescheduled once the worker is declared dead.
+	mr.Wait()
+	reply := mr.Status()
+	if len(reply.Workers) != 2 {
+		t.Fatalf("Status reports %d workers, expected 2\n", len(reply.Workers))
+	}
+	for _, w := range reply.Workers {
+		if (w.Worker == silent) != (w.State == WorkerDead) {
+			t.Fatalf("worker %s is %s\n", w.Worker, w.State)
+		}
+	}
+	check(t, mr.single.files)
+	checkWorker(t, mr.stats)
+	cleanup(mr)
+}
+
+func TestRegisterError(t *testing.T) {
+	// A worker that cannot reach the master is told so, and keeps running.
+	wk := &Worker{name: port("worker0"), clients: newRPCClients()}
+	if wk.register(port("nomaster")) == nil {
+		t.Fatalf("registered with a master that is not running\n")
+	}
+}
+
+func TestWorkerComesBack(t *testing.T) {
+	defer func(interval, suspect, dead, timeout time.Duration) {
+		heartbeatInterval, suspectTimeout, deadTimeout, taskTimeout = interval, suspect, dead, timeout
+	}(heartbeatInterval, suspectTimeout, deadTimeout, taskTimeout)
+	heartbeatInterval, suspectTimeout, deadTimeout = 50*time.Millisecond, 250*time.Millisecond, 500*time.Millisecond
+	taskTimeout = time.Hour
+
+	mr := setup()
+	w := port("worker" + strconv.Itoa(0))
+	resume := make(chan struct{})
+	wk := startSilentWorker(mr.address, w, func(file string, value string, r Reporter) []KeyValue {
+		<-resume
+		return MapFunc(file, value, r)
+	})
+	for mr.workerState(w) != WorkerDead {
+		time.Sleep(heartbeatInterval)
+	}
+
+	// The worker finishes its task while it is dead, which takes its slot out
+	// of the pool. It is the only worker, so the job only completes if it is
+	// given tasks again once its heartbeats resume.
+	close(resume)
+	time.Sleep(5 * heartbeatInterval)
+	go wk.heartbeat(mr.address)
+	mr.Wait()
+	reply := mr.Status()
+	if len(reply.Workers) != 1 || reply.Workers[0].State != WorkerAlive {
+		t.Fatalf("Status reports workers %v, expected %s alive\n", reply.Workers, w)
+	}
+	check(t, mr.single.files)
+	cleanup(mr)
+}
+
 func TestManyFailures(t *testing.T) {
 	mr := setup()
 	i := 0
@@ -212,18 +1057,528 @@ func TestManyFailures(t *testing.T) {
 	for !done {
 		select {
 		case done = <-mr.doneChannel:
-			check(t, mr.files)
+			check(t, mr.single.files)
 			cleanup(mr)
 			break
 		default:
 			// Start 2 workers each sec. The workers fail after 10 tasks
 			w := port("worker" + strconv.Itoa(i))
-			go RunWorker(mr.address, w, MapFunc, ReduceFunc, 10, false)
+			go RunWorker(mr.address, w, MapFunc, ReduceFunc, nil, nil, 1, 10, false)
 			i++
 			w = port("worker" + strconv.Itoa(i))
-			go RunWorker(mr.address, w, MapFunc, ReduceFunc, 10, false)
+			go RunWorker(mr.address, w, MapFunc, ReduceFunc, nil, nil, 1, 10, false)
 			i++
 			time.Sleep(1 * time.Second)
 		}
 	}
 }
+
+func TestConcurrentJobs(t *testing.T) {
+	indir := makeInputs(nMap)
+	mr := StartMaster(port("master"))
+	for i := 0; i < 3; i++ {
+		go RunWorker(mr.address, port("worker"+strconv.Itoa(i)),
+			MapFunc, ReduceFunc, nil, nil, 1, -1, false)
+	}
+	jobs := []string{"test-a", "test-b"}
+	for _, name := range jobs {
+		err := mr.SubmitJob(name, JobConfig{InputDir: indir, NReduce: nReduce})
+		if err != nil {
+			t.Fatalf("submit %s: %v\n", name, err)
+		}
+	}
+	if mr.SubmitJob("test-a", JobConfig{InputDir: indir, NReduce: nReduce}) == nil {
+		t.Fatalf("submitted a job whose name is already running\n")
+	}
+	files, err := getChildrenFiles(indir)
+	checkError(err)
+	for _, name := range jobs {
+		checkError(mr.WaitJob(name))
+		checkOutput(t, "mrtmp."+name, files)
+	}
+	mr.Stop()
+	mr.Wait()
+	checkWorker(t, mr.stats)
+
+	for _, name := range jobs {
+		mr.jobs[name].cleanupFiles()
+	}
+	os.RemoveAll(indir)
+}
+
+// countingMapFunc counts the records it maps with a counter.
+func countingMapFunc(file string, value string, r Reporter) []KeyValue {
+	res := MapFunc(file, value, r)
+	r.AddCounter("records", int64(len(res)))
+	return res
+}
+
+// countingReduceFunc counts the keys it reduces with a counter.
+func countingReduceFunc(key string, values ValueIterator) string {
+	values.AddCounter("keys", 1)
+	return ReduceFunc(key, values)
+}
+
+// checkStatus checks the status of a completed job that counted its records
+// and keys.
+func checkStatus(t *testing.T, status StatusReply) {
+	if len(status.Jobs) != 1 {
+		t.Fatalf("Status reports %d jobs, expected 1\n", len(status.Jobs))
+	}
+	job := status.Jobs[0]
+	if job.Phase != "Done" || job.TasksDone != nReduce || job.TasksRunning != 0 || job.TasksPending != 0 {
+		t.Fatalf("job %s is %s with %d/%d/%d tasks done/running/pending\n",
+			job.JobName, job.Phase, job.TasksDone, job.TasksRunning, job.TasksPending)
+	}
+	if job.Stats.Counters["records"] != nNumber || job.Stats.Counters["keys"] != nNumber {
+		t.Fatalf("counters %v, expected %d records and keys\n", job.Stats.Counters, nNumber)
+	}
+	if job.Stats.BytesRead < job.Stats.InputBytes || job.Stats.InputBytes == 0 || job.Stats.BytesWritten == 0 {
+		t.Fatalf("job read %d of %d bytes and wrote %d\n",
+			job.Stats.BytesRead, job.Stats.InputBytes, job.Stats.BytesWritten)
+	}
+}
+
+func TestSequentialStatus(t *testing.T) {
+	mr := Sequential(context.Background(), "test", JobConfig{InputDir: makeInputs(nMap), NReduce: nReduce}, countingMapFunc, countingReduceFunc, nil)
+	mr.Wait()
+	checkStatus(t, mr.Status())
+	check(t, mr.single.files)
+	cleanup(mr)
+}
+
+func TestStatus(t *testing.T) {
+	mr := setup()
+	for i := 0; i < 2; i++ {
+		go RunWorker(mr.address, port("worker"+strconv.Itoa(i)),
+			countingMapFunc, countingReduceFunc, nil, nil, 1, -1, false)
+	}
+	mr.Wait()
+	checkStatus(t, mr.Status())
+	check(t, mr.single.files)
+	checkWorker(t, mr.stats)
+	cleanup(mr)
+}
+
+// slowMapFunc maps a file slowly enough for a test to cancel its job midway.
+func slowMapFunc(file string, value string, r Reporter) []KeyValue {
+	time.Sleep(100 * time.Millisecond)
+	return MapFunc(file, value, r)
+}
+
+// checkCancelled checks that a job ended with a cancellation error that also
+// wraps want, if not nil, and that its abandoned attempts left no output
+// behind. It then removes the job's files.
+func checkCancelled(t *testing.T, mr *Master, want error) {
+	err := mr.Wait()
+	if !errors.Is(err, ErrCancelled) || (want != nil && !errors.Is(err, want)) {
+		t.Fatalf("cancelled job ended with %v\n", err)
+	}
+	if phase := mr.Status().Jobs[0].Phase; phase != "Cancelled" {
+		t.Fatalf("cancelled job in phase %s\n", phase)
+	}
+	attempts, err := filepath.Glob(filepath.Join(getJobDir(mr.single.config.WorkDir, mr.single.jobName), "*.attempt*"))
+	checkError(err)
+	if len(attempts) > 0 {
+		t.Fatalf("abandoned attempts left %v behind\n", attempts)
+	}
+	os.RemoveAll(getJobDir(mr.single.config.WorkDir, mr.single.jobName))
+	os.RemoveAll(mr.single.config.InputDir)
+}
+
+func TestCancel(t *testing.T) {
+	mr := setup()
+	for i := 0; i < 2; i++ {
+		go RunWorker(mr.address, port("worker"+strconv.Itoa(i)),
+			slowMapFunc, ReduceFunc, nil, nil, 1, -1, false)
+	}
+	time.Sleep(500 * time.Millisecond)
+	status, err := RequestStatus(mr.address)
+	if err != nil || len(status.Jobs) != 1 || status.Jobs[0].Phase != "Map" {
+		t.Fatalf("status before cancelling: %+v, %v\n", status, err)
+	}
+	if RequestCancel(mr.address, "missing") == nil {
+		t.Fatalf("cancelled a job that does not exist\n")
+	}
+	checkError(RequestCancel(mr.address, "test"))
+	checkCancelled(t, mr, nil)
+}
+
+func TestSequentialContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	mr := Sequential(ctx, "test", JobConfig{InputDir: makeInputs(nMap), NReduce: nReduce}, slowMapFunc, ReduceFunc, nil)
+	time.Sleep(300 * time.Millisecond)
+	cancel()
+	checkCancelled(t, mr, context.Canceled)
+}
+
+func TestDistributedContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	mr := Distributed(ctx, "test", JobConfig{InputDir: makeInputs(nMap), NReduce: nReduce}, port("master"))
+	for i := 0; i < 2; i++ {
+		go RunWorker(mr.address, port("worker"+strconv.Itoa(i)),
+			slowMapFunc, ReduceFunc, nil, nil, 2, -1, false)
+	}
+	checkCancelled(t, mr, context.DeadlineExceeded)
+}
+
+func TestSplitLocality(t *testing.T) {
+	split := InputSplit{Ranges: []FileRange{{File: "in/a/mrinput-0.txt"}}, Hosts: []string{"host1"}}
+	for _, c := range []struct {
+		local []string
+		want  bool
+	}{
+		{nil, false},
+		{[]string{"in"}, true},
+		{[]string{"in/a/"}, true},
+		{[]string{"in/b"}, false},
+		{[]string{"i"}, false},
+		{[]string{"host2", "host1"}, true},
+	} {
+		if got := split.isLocalTo(c.local); got != c.want {
+			t.Fatalf("split local to %v: %v, expected %v\n", c.local, got, c.want)
+		}
+	}
+}
+
+func TestLocality(t *testing.T) {
+	defer func(delay time.Duration) { localityDelay = delay }(localityDelay)
+	localityDelay = time.Hour
+
+	// Only the worker without local input counts the map tasks it runs.
+	remoteMapFunc := func(file string, value string, r Reporter) []KeyValue {
+		r.AddCounter("remote", 1)
+		return MapFunc(file, value, r)
+	}
+	mr := setup()
+	go RunWorker(mr.address, port("worker"+strconv.Itoa(0)),
+		MapFunc, ReduceFunc, nil, []string{mr.single.config.InputDir}, 1, -1, false)
+	for len(mr.Status().Workers) == 0 {
+		time.Sleep(10 * time.Millisecond) // the local worker has to be known first
+	}
+	go RunWorker(mr.address, port("worker"+strconv.Itoa(1)),
+		remoteMapFunc, ReduceFunc, nil, []string{"elsewhere"}, 1, -1, false)
+	mr.Wait()
+	status := mr.Status()
+	if n := status.Jobs[0].Stats.Counters["remote"]; n != 0 {
+		t.Fatalf("%d map tasks ran on the worker without local input\n", n)
+	}
+	check(t, mr.single.files)
+	checkWorker(t, mr.stats)
+	cleanup(mr)
+}
+
+func setupLocalShuffle() *Master {
+	files := makeInputs(nMap)
+	master := port("master")
+	config := JobConfig{InputDir: files, NReduce: nReduce, Options: JobOptions{LocalShuffle: true}}
+	return Distributed(context.Background(), "test", config, master)
+}
+
+func TestLocalShuffle(t *testing.T) {
+	// The job runs on a long-lived master, whose workers outlive it.
+	mr := StartMaster(port("master"))
+	for i := 0; i < 2; i++ {
+		go RunWorker(mr.address, port("worker"+strconv.Itoa(i)),
+			MapFunc, ReduceFunc, nil, nil, 1, -1, false)
+	}
+	// Left behind by processes that did not stop their workers.
+	pattern := filepath.Join(os.TempDir(), "mr-shuffle-*", "test")
+	stale, err := filepath.Glob(pattern)
+	checkError(err)
+	config := JobConfig{InputDir: makeInputs(nMap), NReduce: nReduce, Options: JobOptions{LocalShuffle: true}}
+	checkError(mr.SubmitJob("test", config))
+	checkError(mr.WaitJob("test"))
+	if _, err := os.Stat(getIntermediateName(defaultWorkDir, "test", 0, 0)); err == nil {
+		t.Fatalf("map output written to the shared work directory\n")
+	}
+	// The workers are still running, but no longer keep the job's output.
+	kept, err := filepath.Glob(pattern)
+	checkError(err)
+	if len(kept) != len(stale) {
+		t.Fatalf("map output kept after the job completed: %v\n", kept)
+	}
+	mr.Stop()
+	mr.Wait()
+	j := mr.jobs["test"]
+	check(t, j.files)
+	checkWorker(t, mr.stats)
+	j.cleanupFiles()
+	for _, f := range j.files {
+		removeFile(f)
+	}
+	removeFile(j.config.InputDir)
+}
+
+func TestLocalShuffleLostWorker(t *testing.T) {
+	mr := setupLocalShuffle()
+	// The second worker exits after 10 map tasks, taking their output with
+	// it; they are run again on the first one.
+	go RunWorker(mr.address, port("worker"+strconv.Itoa(0)),
+		MapFunc, ReduceFunc, nil, nil, 1, -1, false)
+	go RunWorker(mr.address, port("worker"+strconv.Itoa(1)),
+		MapFunc, ReduceFunc, nil, nil, 1, 10, false)
+	err := mr.Wait()
+	if err != nil {
+		t.Fatalf("job failed: %v\n", err)
+	}
+	if len(mr.single.lostOutputs) == 0 {
+		t.Fatalf("no map output was lost\n")
+	}
+	check(t, mr.single.files)
+	cleanup(mr)
+}
+
+func TestMultiSlotWorker(t *testing.T) {
+	// The map function counts how many of its calls run at once.
+	var running, most int32
+	slowMapFunc := func(file string, value string, r Reporter) []KeyValue {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for m := atomic.LoadInt32(&most); n > m && !atomic.CompareAndSwapInt32(&most, m, n); m = atomic.LoadInt32(&most) {
+		}
+		time.Sleep(10 * time.Millisecond)
+		return MapFunc(file, value, r)
+	}
+	mr := setup()
+	go RunWorker(mr.address, port("worker"+strconv.Itoa(0)),
+		slowMapFunc, ReduceFunc, nil, nil, 4, -1, false)
+	mr.Wait()
+	if most < 2 || most > 4 {
+		t.Fatalf("%d map tasks ran at once on a worker with 4 slots\n", most)
+	}
+	status := mr.Status()
+	if len(status.Workers) != 1 || status.Workers[0].Slots != 4 {
+		t.Fatalf("Status reports workers %v, expected one with 4 slots\n", status.Workers)
+	}
+	check(t, mr.single.files)
+	checkWorker(t, mr.stats)
+	cleanup(mr)
+}
+
+// countNumbers is a typed job that counts the numbers in its input, with the
+// largest number first. Its map function counts the numbers it reads with the
+// "numbers" counter.
+func countNumbers() *Job[int, int, int] {
+	sum := func(n int, counts Iterator[int]) int {
+		total := 0
+		for c, ok := counts.Next(); ok; c, ok = counts.Next() {
+			total += c
+		}
+		return total
+	}
+	return &Job[int, int, int]{
+		Name:   "test",
+		Config: JobConfig{InputDir: makeInputs(nMap), NReduce: nReduce},
+		Map: func(file string, contents string, r Reporter) []Pair[int, int] {
+			var pairs []Pair[int, int]
+			for _, w := range strings.Fields(contents) {
+				n, err := strconv.Atoi(w)
+				checkError(err)
+				pairs = append(pairs, Pair[int, int]{n, 1})
+			}
+			r.AddCounter("numbers", int64(len(pairs)))
+			return pairs
+		},
+		Reduce:  sum,
+		Combine: sum,
+		Less:    func(a, b int) bool { return a > b },
+	}
+}
+
+// checkCounted checks that the merged output of countNumbers counts every
+// number once, from the largest to the smallest.
+func checkCounted(t *testing.T) {
+	output, err := os.ReadFile("mrtmp.test")
+	checkError(err)
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) != nNumber {
+		t.Fatalf("%d lines in output, expected %d\n", len(lines), nNumber)
+	}
+	for i, line := range lines {
+		if want := fmt.Sprintf("%d: 1", nNumber-1-i); line != want {
+			t.Fatalf("line %d: %q, expected %q\n", i, line, want)
+		}
+	}
+}
+
+func TestTypedTryMap(t *testing.T) {
+	// The map function rejects one input file, which fails the job unless
+	// the file is skipped.
+	job := countNumbers()
+	mapF := job.Map
+	job.Map = nil
+	job.TryMap = func(file string, contents string, r Reporter) ([]Pair[int, int], error) {
+		if strings.HasSuffix(file, "mrinput-3.txt") {
+			return nil, fmt.Errorf("rejected %s", file)
+		}
+		return mapF(file, contents, r), nil
+	}
+	mr := job.Sequential(context.Background())
+	err := mr.Wait()
+	te, ok := err.(*TaskError)
+	if !ok || te.Kind != TaskBadInput || te.Record == nil || !strings.HasSuffix(te.Record.File, "mrinput-3.txt") {
+		t.Fatalf("job failed with %v, expected bad input in mrinput-3.txt\n", err)
+	}
+	job.Config.SkipBadRecords = 1
+	mr = job.Sequential(context.Background())
+	if err := mr.Wait(); err != nil {
+		t.Fatalf("job skipping bad records failed: %v\n", err)
+	}
+	cleanup(mr)
+}
+
+func TestDefaultSerde(t *testing.T) {
+	type point struct{ X, Y int }
+	if s := DefaultSerde[int64]().Encode(-42); s != "-42" {
+		t.Fatalf("int64 encoded as %q\n", s)
+	}
+	if v, err := DefaultSerde[float64]().Decode("2.5"); err != nil || v != 2.5 {
+		t.Fatalf("float64 decoded as %v, %v\n", v, err)
+	}
+	p := point{1, 2}
+	if v, err := DefaultSerde[point]().Decode(DefaultSerde[point]().Encode(p)); err != nil || v != p {
+		t.Fatalf("struct decoded as %v, %v\n", v, err)
+	}
+}
+
+func TestTypedSequential(t *testing.T) {
+	job := countNumbers()
+	mr := job.Sequential(context.Background())
+	mr.Wait()
+	checkCounted(t)
+	if n := mr.Status().Jobs[0].Stats.Counters["numbers"]; n != nNumber {
+		t.Fatalf("counted %d numbers, expected %d\n", n, nNumber)
+	}
+	cleanup(mr)
+}
+
+func TestTypedDistributed(t *testing.T) {
+	job := countNumbers()
+	mr := job.Distributed(context.Background(), port("master"))
+	for i := 0; i < 2; i++ {
+		go job.RunWorker(mr.address, port("worker"+strconv.Itoa(i)), nil, 1, -1, false)
+	}
+	mr.Wait()
+	checkCounted(t)
+	if n := mr.Status().Jobs[0].Stats.Counters["numbers"]; n != nNumber {
+		t.Fatalf("counted %d numbers, expected %d\n", n, nNumber)
+	}
+	checkWorker(t, mr.stats)
+	cleanup(mr)
+}
+
+// The latest number per last digit: the numbers are keyed by their last digit
+// and sorted by value, so that the reduce function sees them in increasing
+// order and keeps the last one.
+func TestSecondarySort(t *testing.T) {
+	mapF := func(file string, contents string, r Reporter) (res []KeyValue) {
+		for _, w := range strings.Fields(contents) {
+			n, err := strconv.Atoi(w)
+			checkError(err)
+			key := CompositeKey(strconv.Itoa(n%10), fmt.Sprintf("%06d", n))
+			res = append(res, KeyValue{key, w})
+		}
+		return
+	}
+	reduceF := func(key string, values ValueIterator) string {
+		last := -1
+		for v, ok := values.Next(); ok; v, ok = values.Next() {
+			n, err := strconv.Atoi(v)
+			checkError(err)
+			if n <= last {
+				panic(fmt.Sprintf("%d after %d for %q", n, last, key))
+			}
+			last = n
+		}
+		return strconv.Itoa(last)
+	}
+	for _, distributed := range []bool{false, true} {
+		config := JobConfig{InputDir: makeInputs(nMap), NReduce: 3}
+		config.Options.Partitioner = CompositePartitioner{}
+		config.Options.Grouping = "composite"
+		var mr *Master
+		if distributed {
+			mr = Distributed(context.Background(), "test", config, port("master"))
+			for i := 0; i < 2; i++ {
+				go RunWorker(mr.address, port("worker"+strconv.Itoa(i)),
+					mapF, reduceF, nil, nil, 1, -1, false)
+			}
+		} else {
+			mr = Sequential(context.Background(), "test", config, mapF, reduceF, nil)
+		}
+		if err := mr.Wait(); err != nil {
+			t.Fatalf("job failed (distributed: %v): %v\n", distributed, err)
+		}
+		// The results are written under the groups, the digits.
+		var want strings.Builder
+		for digit := 0; digit < 10; digit++ {
+			fmt.Fprintf(&want, "%d: %d\n", digit, nNumber-10+digit)
+		}
+		output, err := os.ReadFile("mrtmp.test")
+		checkError(err)
+		if string(output) != want.String() {
+			t.Fatalf("output (distributed: %v):\n%s\nexpected:\n%s", distributed, output, want.String())
+		}
+		cleanup(mr)
+	}
+}
+
+func TestRPCClients(t *testing.T) {
+	mr := StartMaster(port("master"))
+	worker := port("worker0")
+	go RunWorker(mr.address, worker, MapFunc, ReduceFunc, nil, nil, 1, 2, false)
+	for len(mr.Status().Workers) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	clients := newRPCClients()
+	defer clients.close()
+	args := &JobArgs{JobName: "test"}
+	for i := 0; i < 2; i++ {
+		if !clients.call(worker, "Worker.Abandon", args, new(struct{})) {
+			t.Fatalf("call %d failed\n", i)
+		}
+	}
+	if len(clients.conns) != 1 {
+		t.Fatalf("%d connections for one worker\n", len(clients.conns))
+	}
+	if clients.call(worker, "Worker.Abandon", args, new(struct{})) {
+		t.Fatalf("worker served an RPC over its limit\n")
+	}
+
+	// A worker started again at the same address is reached over a new
+	// connection.
+	go RunWorker(mr.address, worker, MapFunc, ReduceFunc, nil, nil, 1, -1, false)
+	deadline := time.Now().Add(5 * time.Second)
+	for !clients.call(worker, "Worker.Abandon", args, new(struct{})) {
+		if time.Now().After(deadline) {
+			t.Fatalf("no new connection to the restarted worker\n")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mr.Stop()
+	mr.Wait()
+}
+
+func TestTaskAccounting(t *testing.T) {
+	defer func(threshold time.Duration) { backupThreshold = threshold }(backupThreshold)
+	backupThreshold = time.Hour // no backup copies, so every task runs once
+
+	mr := setup()
+	for i := 0; i < 2; i++ {
+		go RunWorker(mr.address, port("worker"+strconv.Itoa(i)),
+			MapFunc, ReduceFunc, nil, nil, 1, -1, false)
+	}
+	mr.Wait()
+	ntasks := 0
+	for _, n := range mr.stats {
+		ntasks += n
+	}
+	if ntasks != nMap+nReduce {
+		t.Fatalf("workers report %d tasks, expected %d\n", ntasks, nMap+nReduce)
+	}
+	check(t, mr.single.files)
+	cleanup(mr)
+}
@@ -0,0 +1,129 @@
+package mapreduce
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// keyOrdersLock protects keyOrders and keyGroupings, which jobs may register
+// into while the tasks of other jobs read them.
+var keyOrdersLock sync.RWMutex
+
+// The key orders jobs may choose from, by name. A key order decides the order
+// in which reduce functions see their keys and in which keys appear in the
+// merged output; jobs that do not choose one sort keys as strings.
+var keyOrders = map[string]func(a, b string) bool{}
+
+// RegisterKeyOrder makes a custom key order available to jobs under the given
+// name, which they select in JobOptions.KeyOrder. It must be registered under
+// the same name on the master and every worker.
+func RegisterKeyOrder(name string, less func(a, b string) bool) {
+	keyOrdersLock.Lock()
+	defer keyOrdersLock.Unlock()
+	keyOrders[name] = less
+}
+
+// A keyGrouping decides which keys a reduce function is called on together:
+// consecutive keys, in the job's key order, that same says are in the same
+// group. The result of the reduce function is written under the key that
+// groupKey returns for the first key of the group.
+type keyGrouping struct {
+	same     func(a, b string) bool
+	groupKey func(key string) string
+}
+
+// The key groupings jobs may choose from, by name. Jobs that do not choose one
+// group equal keys only. The "composite" grouping groups composite keys by
+// their group part, which its results are written under.
+var keyGroupings = map[string]keyGrouping{
+	"composite": {
+		same: func(a, b string) bool {
+			ga, _ := SplitCompositeKey(a)
+			gb, _ := SplitCompositeKey(b)
+			return ga == gb
+		},
+		groupKey: func(key string) string {
+			group, _ := SplitCompositeKey(key)
+			return group
+		},
+	},
+}
+
+// RegisterKeyGrouping makes a custom key grouping available to jobs under the
+// given name, which they select in JobOptions.Grouping. The result of a
+// group's reduce function is written under groupKey of the group's first key,
+// or under that key itself if groupKey is nil; the keys groupKey returns must
+// follow each other in the job's key order as their groups do. The grouping
+// must be registered under the same name on the master and every worker.
+func RegisterKeyGrouping(name string, sameGroup func(a, b string) bool, groupKey func(key string) string) {
+	if groupKey == nil {
+		groupKey = func(key string) string { return key }
+	}
+	keyOrdersLock.Lock()
+	defer keyOrdersLock.Unlock()
+	keyGroupings[name] = keyGrouping{sameGroup, groupKey}
+}
+
+// checkKeyOrder verifies that the key order and grouping chosen by a job exist.
+func checkKeyOrder(options JobOptions) error {
+	keyOrdersLock.RLock()
+	defer keyOrdersLock.RUnlock()
+	if _, ok := keyOrders[options.KeyOrder]; !ok && options.KeyOrder != "" {
+		return fmt.Errorf("unknown key order %q", options.KeyOrder)
+	}
+	if _, ok := keyGroupings[options.Grouping]; !ok && options.Grouping != "" {
+		return fmt.Errorf("unknown key grouping %q", options.Grouping)
+	}
+	return nil
+}
+
+// keyLess returns the key order of a job.
+func keyLess(options JobOptions) func(a, b string) bool {
+	keyOrdersLock.RLock()
+	defer keyOrdersLock.RUnlock()
+	if less, ok := keyOrders[options.KeyOrder]; ok {
+		return less
+	}
+	return func(a, b string) bool { return a < b }
+}
+
+// groupingOf returns the key grouping of a job.
+func groupingOf(options JobOptions) keyGrouping {
+	keyOrdersLock.RLock()
+	defer keyOrdersLock.RUnlock()
+	if grouping, ok := keyGroupings[options.Grouping]; ok {
+		return grouping
+	}
+	return keyGrouping{
+		same:     func(a, b string) bool { return a == b },
+		groupKey: func(key string) string { return key },
+	}
+}
+
+// The separator of the two parts of a composite key. It sorts before any
+// other character, so composite keys sort as strings by group, then by the
+// rest of the key.
+const compositeKeySeparator = "\x00"
+
+// CompositeKey builds a key for secondary sort: a job that partitions keys
+// with CompositePartitioner and groups them with the "composite" grouping
+// calls its reduce function once per group, with the values of the group's
+// keys in the order of their sort parts, and writes its result under the
+// group. The group must not contain a NUL byte.
+func CompositeKey(group string, sort string) string {
+	return group + compositeKeySeparator + sort
+}
+
+// SplitCompositeKey returns the group and sort parts of a composite key. A key
+// that is not composite is a group of its own with an empty sort part.
+func SplitCompositeKey(key string) (group string, sort string) {
+	group, sort, _ = strings.Cut(key, compositeKeySeparator)
+	return group, sort
+}
+
+// sortKeys sorts keys in the given order.
+func sortKeys(keys []string, less func(a, b string) bool) {
+	sort.Slice(keys, func(i, j int) bool { return less(keys[i], keys[j]) })
+}
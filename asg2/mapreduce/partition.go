@@ -0,0 +1,114 @@
+package mapreduce
+
+import (
+	"encoding/gob"
+	"math/rand"
+	"os"
+	"sort"
+)
+
+// Partitioner decides which reduce task receives a key emitted by a map task.
+// The master ships the job's partitioner to the workers with every map task,
+// so implementations other than the built-in ones must be registered with
+// gob.Register before they are passed to Distributed.
+type Partitioner interface {
+	Partition(key string, nReduce int) int
+}
+
+func init() {
+	gob.Register(HashPartitioner{})
+	gob.Register(&RangePartitioner{})
+	gob.Register(CompositePartitioner{})
+}
+
+// HashPartitioner spreads keys over the reduce tasks by their FNV-1a hash.
+// It is the default when a job does not specify a partitioner.
+type HashPartitioner struct{}
+
+func (HashPartitioner) Partition(key string, nReduce int) int {
+	return int(hash32(key)) % nReduce
+}
+
+// CompositePartitioner spreads composite keys (see CompositeKey) over the
+// reduce tasks by the hash of their group, so that a group is reduced by a
+// single task.
+type CompositePartitioner struct{}
+
+func (CompositePartitioner) Partition(key string, nReduce int) int {
+	group, _ := SplitCompositeKey(key)
+	return HashPartitioner{}.Partition(group, nReduce)
+}
+
+// RangePartitioner assigns keys to reduce tasks by comparing them against a
+// sorted list of split points: reduce task i receives the keys that are at
+// least SplitPoints[i-1] and less than SplitPoints[i]. Since every reducer
+// sorts its own keys, the reducer outputs are globally sorted when read in
+// order, and merge simply concatenates them.
+type RangePartitioner struct {
+	SplitPoints []string
+}
+
+func (p *RangePartitioner) Partition(key string, nReduce int) int {
+	i := sort.Search(len(p.SplitPoints), func(i int) bool {
+		return p.SplitPoints[i] > key
+	})
+	if i >= nReduce {
+		i = nReduce - 1
+	}
+	return i
+}
+
+// NewRangePartitioner picks nReduce-1 split points from a sample of the job's
+// keys so that each reduce task receives roughly the same number of keys.
+func NewRangePartitioner(sample []string, nReduce int) *RangePartitioner {
+	keys := append([]string(nil), sample...)
+	sort.Strings(keys)
+
+	p := new(RangePartitioner)
+	for i := 1; i < nReduce && len(keys) > 0; i++ {
+		split := keys[i*len(keys)/nReduce]
+		if len(p.SplitPoints) == 0 || p.SplitPoints[len(p.SplitPoints)-1] < split {
+			p.SplitPoints = append(p.SplitPoints, split)
+		}
+	}
+	return p
+}
+
+// How many input files SampleKeys runs the map function on.
+const maxSampleFiles = 10
+
+// SampleKeys runs the map function on up to maxSampleFiles input files, spread
+// evenly over the input directory, and returns a uniform sample of at most n
+// of the keys it emits. The result is meant to be fed to NewRangePartitioner.
+func SampleKeys(dirName string, n int,
+	mapF func(string, string, Reporter) []KeyValue,
+) ([]string, error) {
+	files, err := getChildrenFiles(dirName)
+	if err != nil {
+		return nil, err
+	}
+	step := 1
+	if len(files) > maxSampleFiles {
+		step = len(files) / maxSampleFiles
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	var sample []string
+	seen := 0
+	for i := 0; i < len(files); i += step {
+		contents, err := os.ReadFile(files[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, keyval := range mapF(files[i], string(contents), discardCounters) {
+			// Reservoir sampling keeps every key with probability n/seen.
+			seen++
+			if len(sample) < n {
+				sample = append(sample, keyval.Key)
+			} else if j := rnd.Intn(seen); j < n {
+				sample[j] = keyval.Key
+			}
+		}
+	}
+	return sample, nil
+}
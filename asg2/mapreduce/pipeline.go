@@ -0,0 +1,150 @@
+package mapreduce
+
+import (
+	"context"
+	"fmt"
+)
+
+// Stage is one job of a pipeline. Config.InputDir and Config.Options.Input are
+// only used by the first stage; every later stage reads the reducer output of
+// the stage before it.
+type Stage struct {
+	Name    string // Job name, which must be unique within the pipeline
+	Map     func(string, string, Reporter) []KeyValue
+	Reduce  func(string, ValueIterator) string
+	Combine func(string, ValueIterator) string // optional
+	Config  JobConfig
+}
+
+// output returns the input format with which the next stage reads the
+// reducer output of s.
+func (s Stage) output() JobOutput {
+	config := s.Config.withDefaults()
+	return JobOutput{
+		WorkDir:     config.WorkDir,
+		JobName:     s.Name,
+		NReduce:     config.NReduce,
+		Codec:       config.Options.Codec,
+		Compression: config.Options.Compression,
+	}
+}
+
+// SequentialPipeline runs a chain of jobs sequentially, as Sequential does, until
+// ctx is done. The first stage reads the files in its input directory, and
+// every other stage reads the reducer output files of the previous one
+// directly, so for example a word count can be followed by a job picking the
+// most frequent words. Each stage is merged into mrtmp.<Name> like any other
+// job; once Wait returns, the master's job is the last stage, or the stage that
+// failed. A pipeline that is invalid as a whole fails before any stage runs, as
+// its first stage.
+func SequentialPipeline(ctx context.Context, stages []Stage) (mr *Master) {
+	mr = newMaster("master")
+	// There are no workers to keep map output on.
+	stages = append([]Stage(nil), stages...)
+	for i := range stages {
+		stages[i].Config.Options.LocalShuffle = false
+	}
+	go func() {
+		ntasks := mr.runStages(ctx, stages, func(j *job, s Stage) func(phase jobPhase) error {
+			return mr.sequentialSchedule(j, s.Map, s.Reduce, s.Combine)
+		})
+		mr.stats = []int{ntasks}
+		mr.doneChannel <- true
+	}()
+	return
+}
+
+// DistributedPipeline runs a chain of jobs as SequentialPipeline does, each
+// stage being submitted to the master as a job on its pool of workers once the
+// stage before it has completed. The workers are started with
+// RunPipelineWorker, given the same stages. Once the last stage has completed,
+// or one has failed, the workers are shut down as with Distributed.
+func DistributedPipeline(ctx context.Context, stages []Stage, master string) (mr *Master) {
+	mr = newMaster(master)
+	mr.startRPCServer()
+	go func() {
+		mr.runStages(ctx, stages, func(j *job, _ Stage) func(phase jobPhase) error {
+			return func(phase jobPhase) error {
+				return mr.schedule(j, phase)
+			}
+		})
+		mr.Stop()
+	}()
+	return
+}
+
+// runStages runs the stages of a pipeline one after the other, scheduling the
+// tasks of each with the function schedule returns for it, and returns the
+// number of tasks they ran. The reducer output a stage reads is discarded once
+// the stage has completed, as the retention policy of the stage that wrote it
+// says.
+func (mr *Master) runStages(ctx context.Context, stages []Stage, schedule func(j *job, s Stage) func(phase jobPhase) error) int {
+	if err := checkStages(stages); err != nil {
+		var first Stage
+		if len(stages) > 0 {
+			first = stages[0]
+		}
+		mr.single = failedJob(first.Name, first.Config, err)
+		return 0
+	}
+	ntasks := 0
+	var prev *job
+	for i, s := range stages {
+		config := s.Config
+		config.Options.Combine = s.Combine != nil
+		if i > 0 {
+			// The splits of a stage can only be computed once the
+			// previous stage has written its output.
+			config.InputDir = ""
+			config.Options.Input = stages[i-1].output()
+		}
+		if i < len(stages)-1 && config.Retention > KeepReduceOutput {
+			// The next stage reads the reducer output; it is
+			// discarded once that stage has completed.
+			config.Retention = KeepReduceOutput
+		}
+		j, err := newJob(ctx, s.Name, config)
+		if err != nil {
+			mr.single = failedJob(s.Name, config, err)
+			break
+		}
+		mr.single = j
+		mr.Lock()
+		mr.jobs[s.Name] = j
+		mr.Unlock()
+		mr.run(j, schedule(j, s))
+		if j.err != nil {
+			break
+		}
+		if prev != nil {
+			prev.config.Retention = stages[i-1].Config.Retention
+			prev.discardOutputs(prev.config.Retention)
+		}
+		prev = j
+		ntasks += len(j.splits) + j.config.NReduce
+	}
+	return ntasks
+}
+
+// checkStages tells why a pipeline cannot be run, if it cannot: it has no
+// stages, two of them share a name, or one has invalid options.
+func checkStages(stages []Stage) error {
+	if len(stages) == 0 {
+		return fmt.Errorf("pipeline has no stages")
+	}
+	names := make(map[string]bool)
+	for _, s := range stages {
+		if names[s.Name] {
+			return fmt.Errorf("pipeline has two stages named %s", s.Name)
+		}
+		names[s.Name] = true
+		err := checkEncoding(s.Config.Options)
+		if err == nil {
+			err = checkKeyOrder(s.Config.Options)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package mapreduce
+
+import (
+	"io"
+	"sort"
+	"sync"
+)
+
+// TaskStats measures the work done by a task attempt.
+type TaskStats struct {
+	InputBytes   int64 // how much the task has to read in all
+	BytesRead    int64
+	BytesWritten int64
+	Counters     map[string]int64 // user-defined counters, see Reporter
+}
+
+// add accumulates the work of another attempt.
+func (s *TaskStats) add(other TaskStats) {
+	s.InputBytes += other.InputBytes
+	s.BytesRead += other.BytesRead
+	s.BytesWritten += other.BytesWritten
+	for name, n := range other.Counters {
+		if s.Counters == nil {
+			s.Counters = make(map[string]int64)
+		}
+		s.Counters[name] += n
+	}
+}
+
+// TaskProgress describes a task attempt that a worker is running.
+type TaskProgress struct {
+	JobName string
+	Phase   jobPhase
+	Task    int
+	Attempt int
+	Worker  string
+	Stats   TaskStats
+}
+
+// JobStatus describes the progress of a job.
+type JobStatus struct {
+	JobName string
+	Phase   string // "Pending", "Map", "Reduce", "Done", "Failed" or "Cancelled"
+	Err     string // why the job failed
+
+	// Tasks of the current phase.
+	TasksDone    int
+	TasksRunning int
+	TasksPending int
+
+	// The work of the committed task attempts, counters included.
+	Stats TaskStats
+
+	Running []TaskProgress // attempts in flight, as last reported by workers
+}
+
+// Status reports the state of the master's workers and the progress of its
+// jobs.
+func (mr *Master) Status() StatusReply {
+	mr.Lock()
+	defer mr.Unlock()
+	var reply StatusReply
+	for _, w := range mr.workers {
+		reply.Workers = append(reply.Workers, WorkerStatus{
+			Worker:        w,
+			State:         mr.stateLocked(w),
+			LastHeartbeat: mr.lastHeartbeat[w],
+			Local:         mr.workerLocal[w],
+			Slots:         mr.workerSlots[w],
+		})
+	}
+
+	names := make([]string, 0, len(mr.jobs))
+	for name := range mr.jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		j := mr.jobs[name]
+		status := j.status
+		status.JobName = j.jobName
+		status.Stats = TaskStats{}
+		status.Stats.add(j.status.Stats) // copies the counters
+
+		for _, w := range mr.workers {
+			if mr.stateLocked(w) == WorkerDead {
+				continue
+			}
+			for _, p := range mr.workerTasks[w] {
+				if p.JobName == j.jobName {
+					status.Running = append(status.Running, p)
+				}
+			}
+		}
+		reply.Jobs = append(reply.Jobs, status)
+	}
+	return reply
+}
+
+// setPhase records the phase a job has reached. A job that has completed or
+// failed keeps reporting the tasks of its last phase.
+func (mr *Master) setPhase(j *job, phase string) {
+	mr.Lock()
+	defer mr.Unlock()
+	j.status.Phase = phase
+	if phase == string(mapPhase) || phase == string(reducePhase) {
+		j.status.TasksDone, j.status.TasksRunning, j.status.TasksPending = 0, 0, 0
+	}
+	if j.err != nil {
+		j.status.Err = j.err.Error()
+	}
+}
+
+// setTasks records how far the current phase of a job has got.
+func (mr *Master) setTasks(j *job, done int, running int, pending int) {
+	mr.Lock()
+	defer mr.Unlock()
+	j.status.TasksDone, j.status.TasksRunning, j.status.TasksPending = done, running, pending
+}
+
+// addCommitted adds the work of a committed task attempt to its job.
+func (mr *Master) addCommitted(j *job, stats TaskStats) {
+	mr.Lock()
+	defer mr.Unlock()
+	j.status.Stats.add(stats)
+}
+
+// Reporter adds to the user-defined counters of the job whose task a user
+// function runs in. Map functions are given one; the values that reduce and
+// combine functions are given are one too.
+type Reporter interface {
+	AddCounter(name string, delta int64)
+}
+
+// discardCounters is the Reporter of map functions run outside of a task, such
+// as by SampleKeys.
+var discardCounters Reporter = (*taskStats)(nil)
+
+// taskStats collects the TaskStats of a running attempt, which the worker's
+// heartbeat reads while the task updates them. A nil *taskStats discards
+// everything.
+type taskStats struct {
+	sync.Mutex
+	stats TaskStats
+}
+
+func newTaskStats() *taskStats {
+	return &taskStats{stats: TaskStats{Counters: make(map[string]int64)}}
+}
+
+func (ts *taskStats) input(n int64) {
+	if ts != nil {
+		ts.Lock()
+		ts.stats.InputBytes += n
+		ts.Unlock()
+	}
+}
+
+func (ts *taskStats) read(n int64) {
+	if ts != nil {
+		ts.Lock()
+		ts.stats.BytesRead += n
+		ts.Unlock()
+	}
+}
+
+func (ts *taskStats) wrote(n int64) {
+	if ts != nil {
+		ts.Lock()
+		ts.stats.BytesWritten += n
+		ts.Unlock()
+	}
+}
+
+func (ts *taskStats) AddCounter(name string, delta int64) {
+	if ts != nil {
+		ts.Lock()
+		ts.stats.Counters[name] += delta
+		ts.Unlock()
+	}
+}
+
+func (ts *taskStats) snapshot() TaskStats {
+	if ts == nil {
+		return TaskStats{}
+	}
+	ts.Lock()
+	defer ts.Unlock()
+	s := ts.stats
+	s.Counters = nil
+	s.add(TaskStats{Counters: ts.stats.Counters})
+	return s
+}
+
+// countingReader and countingWriter count the bytes of a task's files.
+type countingReader struct {
+	r     io.Reader
+	stats *taskStats
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.stats.read(int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w     io.Writer
+	stats *taskStats
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.stats.wrote(int64(n))
+	return n, err
+}
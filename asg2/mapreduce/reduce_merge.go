@@ -0,0 +1,104 @@
+package mapreduce
+
+import (
+	"container/heap"
+	"io"
+)
+
+// runReader is a cursor over one sorted run: an intermediate file of a reduce
+// task, or a reducer output that merge combines with the others.
+type runReader struct {
+	index   int // the map task, or reduce task, that wrote the run
+	decoder RecordDecoder
+	head    KeyValue // the next record of the run
+	err     error    // why the run ended, if not at the end of its file
+}
+
+// advance reads the next record of the run into head. It returns false once
+// the run is exhausted.
+func (r *runReader) advance() bool {
+	r.head = KeyValue{}
+	err := r.decoder.Decode(&r.head)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return err == nil
+}
+
+// runHeap is a min-heap of runs ordered by their next key, in the job's key
+// order. Runs with equal keys are ordered by the task that wrote them, so a
+// key's values reach the reducer in the same order regardless of how the runs
+// are interleaved.
+type runHeap struct {
+	runs []*runReader
+	less func(a, b string) bool
+}
+
+func (h *runHeap) Len() int { return len(h.runs) }
+
+func (h *runHeap) Less(i, j int) bool {
+	if h.runs[i].head.Key != h.runs[j].head.Key {
+		return h.less(h.runs[i].head.Key, h.runs[j].head.Key)
+	}
+	return h.runs[i].index < h.runs[j].index
+}
+
+func (h *runHeap) Swap(i, j int) { h.runs[i], h.runs[j] = h.runs[j], h.runs[i] }
+
+func (h *runHeap) Push(x interface{}) { h.runs = append(h.runs, x.(*runReader)) }
+
+func (h *runHeap) Pop() interface{} {
+	old := h.runs
+	r := old[len(old)-1]
+	h.runs = old[:len(old)-1]
+	return r
+}
+
+// groupIterator streams the values of one group of keys out of the merged
+// runs: the values of key, followed by those of the keys after it that are in
+// the same group, in the job's key order.
+type groupIterator struct {
+	runs  *runHeap
+	key   string // the first key of the group
+	same  func(a, b string) bool
+	stats *taskStats // the counters AddCounter adds to
+}
+
+func (it *groupIterator) AddCounter(name string, delta int64) { it.stats.AddCounter(name, delta) }
+
+func (it *groupIterator) Next() (string, bool) {
+	if it.runs.Len() == 0 || !it.same(it.key, it.runs.runs[0].head.Key) {
+		return "", false
+	}
+	run := it.runs.runs[0]
+	value := run.head.Value
+	if run.advance() {
+		heap.Fix(it.runs, 0)
+	} else {
+		heap.Pop(it.runs)
+	}
+	return value, true
+}
+
+// skip discards the values of the key that the reducer did not read.
+func (it *groupIterator) skip() {
+	for _, ok := it.Next(); ok; _, ok = it.Next() {
+	}
+}
+
+// sliceIterator is a ValueIterator over values held in memory.
+type sliceIterator struct {
+	values []string
+	stats  *taskStats // the counters AddCounter adds to
+}
+
+func (it *sliceIterator) AddCounter(name string, delta int64) { it.stats.AddCounter(name, delta) }
+
+func (it *sliceIterator) Next() (string, bool) {
+	if len(it.values) == 0 {
+		return "", false
+	}
+	value := it.values[0]
+	it.values = it.values[1:]
+	return value, true
+}
@@ -1,49 +1,453 @@
 package mapreduce
 
 import (
-    "sync"
+	"context"
+	"errors"
+	"time"
 )
 
-func (mr *Master) schedule(phase jobPhase) {
-    var ntasks int
-    var numOtherPhase int
-    switch phase {
-    case mapPhase:
-        ntasks = len(mr.files)     // number of map tasks
-        numOtherPhase = mr.nReduce // number of reducers
-    case reducePhase:
-        ntasks = mr.nReduce           // number of reduce tasks
-        numOtherPhase = len(mr.files) // number of map tasks
-    }
-
-    debug("Schedule: %v %v tasks (%d I/Os)\n", ntasks, phase, numOtherPhase)
-
-    var wg sync.WaitGroup
-    wg.Add(ntasks)
-    for i := 0; i < ntasks; i++ {
-        go func(taskNumber int) {
-            for {
-                worker := <-mr.registerChannel
-                taskArgs := &RunTaskArgs{
-                    JobName:       mr.jobName,
-                    File:          mr.files[taskNumber],
-                    Phase:         phase,
-                    TaskNumber:    taskNumber,
-                    NumOtherPhase: numOtherPhase,
-                }
-                success := call(worker, "RunTask", taskArgs, new(struct{}))
-                if success {
-                    mr.registerChannel <- worker
-                    break
-                } else {
-                    debug("Task %v failed, reassigning to another worker\n", taskNumber)
-                    continue
-                }
-            }
-            wg.Done()
-        }(i)
-    }
-    wg.Wait()
-
-    debug("Schedule: %v phase done\n", phase)
+// An attempt that has been running for longer than backupThreshold is a
+// straggler: once a phase has no unassigned tasks left, idle workers run backup
+// copies of its stragglers and the first copy to complete wins. An attempt that
+// has been running for longer than taskTimeout is abandoned, its worker is
+// considered hung, and the task is rescheduled. The worker is told to stop the
+// attempt, and given taskTimeout again to return from it before the master
+// stops waiting.
+var (
+	backupThreshold = 2 * time.Second
+	taskTimeout     = 10 * time.Second
+)
+
+// How often the scheduler checks running attempts against their deadlines.
+const deadlineCheckInterval = 100 * time.Millisecond
+
+// taskAttempt is a single execution of a task on a worker.
+type taskAttempt struct {
+	task      int
+	attempt   int // numbers the attempts at a task, names its output files
+	worker    string
+	started   time.Time
+	ok        bool       // whether the RunTask RPC succeeded, set once it returns
+	err       *TaskError // why the task failed on the worker, if it did
+	stats     TaskStats  // the work the attempt did, set once the RPC returns
+	abandoned bool       // the attempt timed out and no longer counts as in flight
+	giveUp    func()     // stops waiting for the worker to return from the attempt
+	joined    int        // the worker's joins to the pool when the attempt started
+}
+
+// schedule runs the tasks of one phase of a job on the master's workers. Jobs
+// running side by side draw their workers from the same pool, each taking no
+// more than its fair share while the others have work too. A task that keeps
+// failing with a TaskError fails the phase, and schedule returns that error.
+//
+// A cancelled job stops scheduling tasks and tells the workers running its
+// attempts to abandon them. schedule waits for those attempts to return, for
+// no longer than taskTimeout, removes their output and returns ErrCancelled.
+//
+// If the job shuffles map output between workers, the reduce phase stops with
+// errMapOutputLost as soon as a reduce task cannot fetch the output of a map
+// task, or the worker holding it dies. The map task is then no longer
+// committed, for the map phase to run it again.
+func (mr *Master) schedule(j *job, phase jobPhase) error {
+	var ntasks int
+	var numOtherPhase int
+	switch phase {
+	case mapPhase:
+		ntasks = len(j.splits)           // number of map tasks
+		numOtherPhase = j.config.NReduce // number of reducers
+	case reducePhase:
+		ntasks = j.config.NReduce     // number of reduce tasks
+		numOtherPhase = len(j.splits) // number of map tasks
+	}
+
+	debug("Schedule: %v %v tasks (%d I/Os)\n", ntasks, phase, numOtherPhase)
+
+	var pending []int // tasks waiting for a worker
+	queued := make([]bool, ntasks)
+	done := make([]bool, ntasks)
+	nDone := 0
+	for i := 0; i < ntasks; i++ {
+		if j.journal.isCommitted(phase, i) {
+			done[i] = true // finished by an earlier run of the job
+			nDone++
+			continue
+		}
+		pending = append(pending, i)
+		queued[i] = true
+	}
+	running := make(map[*taskAttempt]bool)
+	failures := make([]int, ntasks) // attempts failed with a TaskError per task
+	failedOn := make([]map[string]bool, ntasks)
+	var failure error // set once the phase cannot complete
+	var lost []int    // map tasks whose output is gone
+	var mapOutputs []MapOutput
+	if phase == reducePhase {
+		mapOutputs = j.mapOutputs()
+	}
+	var idle []string
+	idleSince := make(map[string]time.Time) // since when each worker has had an idle slot
+
+	finished := make(chan *taskAttempt)
+	phaseDone := make(chan struct{})
+	ticker := time.NewTicker(deadlineCheckInterval)
+	defer ticker.Stop()
+
+	// inFlight counts the attempts of a task that have not been abandoned.
+	inFlight := func(task int) int {
+		n := 0
+		for a := range running {
+			if a.task == task && !a.abandoned {
+				n++
+			}
+		}
+		return n
+	}
+
+	// active counts the attempts that have not been abandoned.
+	active := func() int {
+		n := 0
+		for a := range running {
+			if !a.abandoned {
+				n++
+			}
+		}
+		return n
+	}
+
+	requeue := func(task int) {
+		if !done[task] && !queued[task] && inFlight(task) == 0 {
+			pending = append(pending, task)
+			queued[task] = true
+		}
+	}
+
+	start := func(task int, worker string) {
+		id := taskID{phase, task}
+		ctx, giveUp := context.WithCancel(context.Background())
+		a := &taskAttempt{task: task, attempt: j.attempts[id], worker: worker, started: time.Now(), giveUp: giveUp}
+		mr.Lock()
+		a.joined = mr.workerJoins[worker]
+		mr.Unlock()
+		j.attempts[id]++
+		running[a] = true
+		args := &RunTaskArgs{
+			JobName:       j.jobName,
+			WorkDir:       j.config.WorkDir,
+			Phase:         phase,
+			TaskNumber:    task,
+			Attempt:       a.attempt,
+			Skip:          j.skipList(phase, task),
+			NumOtherPhase: numOtherPhase,
+			Options:       j.config.Options,
+			MapOutputs:    mapOutputs,
+		}
+		if phase == mapPhase {
+			args.Split = j.splits[task]
+		}
+		go func() {
+			defer giveUp()
+			reply := new(RunTaskReply)
+			a.ok = mr.clients.callContext(ctx, worker, "Worker.RunTask", args, reply)
+			if a.ok {
+				a.err = reply.Err
+				a.stats = reply.Stats
+			}
+			select {
+			case finished <- a:
+			case <-phaseDone:
+				// The phase completed without this attempt; a worker that is
+				// still alive is handed over to whoever schedules next.
+				mr.discardAttempt(j, phase, a)
+				if a.ok && !mr.rejoined(a) {
+					mr.registerChannel <- worker
+				}
+			}
+		}()
+	}
+
+	// abandon gives up on an attempt that timed out or whose worker died,
+	// and tells the worker to stop it.
+	abandon := func(a *taskAttempt) {
+		a.abandoned = true
+		args := &AttemptArgs{JobName: j.jobName, Phase: phase, Task: a.task, Attempt: a.attempt}
+		go mr.clients.call(a.worker, "Worker.AbandonAttempt", args, new(struct{}))
+		time.AfterFunc(taskTimeout, a.giveUp)
+		requeue(a.task)
+	}
+
+	// straggler returns the oldest attempt that deserves a backup copy, if any.
+	straggler := func() *taskAttempt {
+		var oldest *taskAttempt
+		for a := range running {
+			if a.abandoned || done[a.task] || time.Since(a.started) < backupThreshold || inFlight(a.task) > 1 {
+				continue
+			}
+			if oldest == nil || a.started.Before(oldest.started) {
+				oldest = a
+			}
+		}
+		return oldest
+	}
+
+	// nextTask picks the task an idle worker should run: the next pending one
+	// or, if there are none left, a backup copy of the oldest straggler. A task
+	// that failed on the worker before is left for the other workers, unless
+	// it has failed on all of them. Map tasks whose input the worker reads
+	// locally go first; a task whose input is elsewhere is only given to the
+	// worker once it has waited for localityDelay, or if no live worker reads
+	// that input locally.
+	nextTask := func(worker string) (int, bool) {
+		live := mr.liveWorkers()
+		remote := -1
+		waiting := false // leaving a task to a worker that reads its input locally
+		for i := 0; i < len(pending); i++ {
+			task := pending[i]
+			if done[task] {
+				pending = append(pending[:i], pending[i+1:]...)
+				queued[task] = false
+				i--
+				continue
+			}
+			if failedOn[task][worker] && len(failedOn[task]) < live {
+				continue
+			}
+			if phase == mapPhase && !mr.isLocal(worker, j.splits[task]) {
+				if time.Since(idleSince[worker]) < localityDelay && mr.hasLocalWorker(j.splits[task]) {
+					waiting = true
+				} else if remote < 0 {
+					remote = i
+				}
+				continue
+			}
+			pending = append(pending[:i], pending[i+1:]...)
+			queued[task] = false
+			return task, true
+		}
+		if remote >= 0 {
+			task := pending[remote]
+			pending = append(pending[:remote], pending[remote+1:]...)
+			queued[task] = false
+			return task, true
+		}
+		if waiting {
+			return 0, false
+		}
+		straggler := straggler()
+		if straggler == nil {
+			return 0, false
+		}
+		debug("Schedule: launching backup of %v task %d (slow on %s)\n", phase, straggler.task, straggler.worker)
+		return straggler.task, true
+	}
+
+	// progress records how many tasks are done, in flight and waiting, for
+	// Status to report.
+	progress := func() {
+		inProgress := make(map[int]bool)
+		for a := range running {
+			if !a.abandoned && !done[a.task] {
+				inProgress[a.task] = true
+			}
+		}
+		mr.setTasks(j, nDone, len(inProgress), ntasks-nDone-len(inProgress))
+	}
+
+	for nDone < ntasks && failure == nil && len(lost) == 0 {
+		progress()
+
+		// Only take workers from the pool while the job has something for
+		// them to do and does not exceed its share.
+		var incoming chan string
+		if mr.mayTakeWorker(j, active(), len(pending) > 0 || straggler() != nil) {
+			incoming = mr.registerChannel
+		}
+
+		select {
+		case worker := <-incoming:
+			idle = append(idle, worker)
+		case a := <-finished:
+			delete(running, a)
+			if !a.ok {
+				debug("Task %v failed on %s, reassigning to another worker\n", a.task, a.worker)
+				mr.discardAttempt(j, phase, a)
+				requeue(a.task)
+				break
+			}
+			if !mr.rejoined(a) {
+				idle = append(idle, a.worker)
+			}
+			if a.err != nil {
+				mr.discardAttempt(j, phase, a)
+				if done[a.task] {
+					break
+				}
+				if a.abandoned && a.err.Kind == TaskAbandoned {
+					requeue(a.task) // stopped after it timed out
+					break
+				}
+				if a.err.Kind == TaskFetchFailed && a.err.Lost != nil {
+					debug("Task %v could not fetch the output of map task %d\n", a.task, *a.err.Lost)
+					lost = append(lost, *a.err.Lost)
+					break
+				}
+				failures[a.task]++
+				if failedOn[a.task] == nil {
+					failedOn[a.task] = make(map[string]bool)
+				}
+				failedOn[a.task][a.worker] = true
+				if j.noteBadRecord(a.err) {
+					// Re-executions skip the record, so they start
+					// over with a clean slate.
+					failures[a.task] = 0
+					failedOn[a.task] = nil
+				}
+				if !retryTask(a.err, failures[a.task]) {
+					failure = a.err
+					break
+				}
+				debug("Task %v failed on %s (%v), reassigning to another worker\n", a.task, a.worker, a.err)
+				requeue(a.task)
+				break
+			}
+			if done[a.task] {
+				debug("Schedule: ignoring duplicate completion of %v task %d by %s\n", phase, a.task, a.worker)
+				mr.discardAttempt(j, phase, a)
+				break
+			}
+			err := j.commitTask(phase, a.task, a.attempt, a.worker)
+			if err != nil {
+				debug("Schedule: commit of %v task %d failed: %v\n", phase, a.task, err)
+				mr.discardAttempt(j, phase, a)
+				requeue(a.task)
+				break
+			}
+			mr.addCommitted(j, a.stats)
+			done[a.task] = true
+			nDone++
+		case <-j.ctx.Done():
+			failure = j.cancelled()
+		case now := <-ticker.C:
+			for a := range running {
+				if a.abandoned {
+					continue
+				}
+				if now.Sub(a.started) > taskTimeout {
+					debug("Task %v timed out on %s, reassigning to another worker\n", a.task, a.worker)
+					abandon(a)
+				} else if mr.workerState(a.worker) == WorkerDead {
+					debug("Task %v lost with silent worker %s, reassigning to another worker\n", a.task, a.worker)
+					abandon(a)
+				}
+			}
+			for task, output := range mapOutputs {
+				if mr.workerState(output.Worker) == WorkerDead {
+					debug("Map task %d lost with worker %s\n", task, output.Worker)
+					lost = append(lost, task)
+				}
+			}
+		}
+
+		for _, worker := range idle {
+			if _, ok := idleSince[worker]; !ok {
+				idleSince[worker] = time.Now()
+			}
+		}
+		var kept, waiting []string
+		for _, worker := range idle {
+			if mr.workerState(worker) == WorkerDead {
+				continue
+			}
+			if failure != nil {
+				kept = append(kept, worker) // handed back once the phase stops
+				continue
+			}
+			if !mr.mayTakeWorker(j, active(), true) {
+				waiting = append(waiting, worker)
+				continue
+			}
+			task, ok := nextTask(worker)
+			if ok {
+				start(task, worker)
+			} else if len(pending) > 0 {
+				// The tasks left failed on this worker, or it waits for
+				// one whose input is local. It is kept in case all the
+				// other workers fail them too, or the wait runs out.
+				kept = append(kept, worker)
+			} else {
+				waiting = append(waiting, worker)
+			}
+		}
+
+		// Hand the workers this job has no use for over to the other jobs.
+		for _, worker := range waiting {
+			go func(worker string) {
+				mr.registerChannel <- worker
+			}(worker)
+		}
+		idle = kept
+		for worker := range idleSince {
+			if !contains(idle, worker) {
+				delete(idleSince, worker)
+			}
+		}
+	}
+	if errors.Is(failure, ErrCancelled) {
+		workers := make(map[string]bool)
+		for a := range running {
+			workers[a.worker] = true
+		}
+		for worker := range workers {
+			go mr.clients.call(worker, "Worker.Abandon", &JobArgs{JobName: j.jobName}, new(struct{}))
+		}
+		deadline := time.After(taskTimeout)
+	abandon:
+		for len(running) > 0 {
+			select {
+			case a := <-finished:
+				delete(running, a)
+				mr.discardAttempt(j, phase, a)
+				if a.ok && !mr.rejoined(a) {
+					idle = append(idle, a.worker)
+				}
+			case <-deadline:
+				for a := range running {
+					a.giveUp()
+				}
+				break abandon
+			}
+		}
+	}
+	close(phaseDone)
+	progress()
+	mr.mayTakeWorker(j, 0, false)
+	for _, worker := range idle {
+		go func(worker string) {
+			mr.registerChannel <- worker
+		}(worker)
+	}
+	for _, task := range lost {
+		if failure == nil {
+			failure = j.loseMapOutput(task)
+		}
+	}
+	if failure != nil {
+		debug("Schedule: %v phase failed: %v\n", phase, failure)
+		return failure
+	}
+	if len(lost) > 0 {
+		debug("Schedule: %v phase stopped, map output lost\n", phase)
+		return errMapOutputLost
+	}
+
+	debug("Schedule: %v phase done\n", phase)
+	return nil
+}
+
+func contains(workers []string, worker string) bool {
+	for _, w := range workers {
+		if w == worker {
+			return true
+		}
+	}
+	return false
 }
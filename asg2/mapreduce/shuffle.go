@@ -0,0 +1,183 @@
+package mapreduce
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Reduce tasks fetch map output that stayed on the worker that wrote it in
+// chunks of fetchChunkSize bytes, one Worker.FetchPartition RPC at a time.
+const fetchChunkSize = 1 << 20
+
+// FetchPartition is called by reduce tasks on other workers to read the output
+// that an attempt at a map task run by this worker wrote for them.
+func (wk *Worker) FetchPartition(args *FetchArgs, reply *FetchReply) error {
+	dir := wk.shuffleRoot()
+	if dir == "" {
+		return os.ErrNotExist
+	}
+	name := getAttemptName(getIntermediateName(dir, args.JobName, args.MapTask, args.ReduceTask), args.Attempt)
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	reply.Size = info.Size()
+	n := reply.Size - args.Offset
+	if n > fetchChunkSize {
+		n = fetchChunkSize
+	}
+	if n <= 0 {
+		return nil
+	}
+	reply.Data = make([]byte, n)
+	_, err = file.ReadAt(reply.Data, args.Offset)
+	return err
+}
+
+// DiscardAttempt is called by the master to remove the output kept for an
+// attempt at a map task that it did not commit.
+func (wk *Worker) DiscardAttempt(args *DiscardArgs, _ *struct{}) error {
+	dir := wk.shuffleRoot()
+	if dir == "" {
+		return nil
+	}
+	for i := 0; i < args.NReduce; i++ {
+		os.Remove(getAttemptName(getIntermediateName(dir, args.JobName, args.MapTask, i), args.Attempt))
+	}
+	return nil
+}
+
+// DropJob is called by the master once a job that shuffles map output between
+// workers has completed or been cancelled, to remove all the output the worker
+// kept for it.
+func (wk *Worker) DropJob(args *JobArgs, _ *struct{}) error {
+	dir := wk.shuffleRoot()
+	if dir == "" {
+		return nil
+	}
+	return os.RemoveAll(getJobDir(dir, args.JobName))
+}
+
+// shuffleRoot returns the directory under which the worker keeps map output,
+// or "" if it has kept none.
+func (wk *Worker) shuffleRoot() string {
+	wk.Lock()
+	defer wk.Unlock()
+	return wk.shuffleDir
+}
+
+// shuffleWorkDir returns the directory under which the worker keeps the map
+// output of jobs that shuffle it between workers, creating it on first use.
+// The master has the directory of a job removed once the job is over; the
+// whole directory is removed once the worker has stopped and its tasks have
+// ended.
+func (wk *Worker) shuffleWorkDir(jobName string) (string, error) {
+	wk.Lock()
+	defer wk.Unlock()
+	if wk.shuffleDir == "" {
+		dir, err := os.MkdirTemp("", "mr-shuffle-")
+		if err != nil {
+			return "", err
+		}
+		wk.shuffleDir = dir
+	}
+	return wk.shuffleDir, os.MkdirAll(getJobDir(wk.shuffleDir, jobName), 0755)
+}
+
+// removeShuffleDir removes the map output the worker kept.
+func (wk *Worker) removeShuffleDir() {
+	wk.Lock()
+	defer wk.Unlock()
+	if wk.shuffleDir != "" {
+		os.RemoveAll(wk.shuffleDir)
+	}
+}
+
+// fetchError reports that the output of a map task could not be fetched from
+// the worker holding it.
+type fetchError struct {
+	mapTask int
+	worker  string
+}
+
+func (e *fetchError) Error() string {
+	return fmt.Sprintf("cannot fetch output of map task %d from %s", e.mapTask, e.worker)
+}
+
+// partitionReader reads the output a map task wrote for a reduce task from
+// the worker that kept it, fetching one chunk at a time.
+type partitionReader struct {
+	worker  string
+	clients *rpcClients
+	args    FetchArgs
+	stats   *taskStats
+	size    int64 // -1 until the first chunk has been fetched
+	pending []byte
+}
+
+func newPartitionReader(jobName string, mapTask int, reduceTask int, output MapOutput, clients *rpcClients, stats *taskStats) *partitionReader {
+	return &partitionReader{
+		worker:  output.Worker,
+		clients: clients,
+		args:    FetchArgs{JobName: jobName, MapTask: mapTask, ReduceTask: reduceTask, Attempt: output.Attempt},
+		stats:   stats,
+		size:    -1,
+	}
+}
+
+func (pr *partitionReader) Read(p []byte) (int, error) {
+	if len(pr.pending) == 0 {
+		if pr.size >= 0 && pr.args.Offset >= pr.size {
+			return 0, io.EOF
+		}
+		var reply FetchReply
+		ok := pr.clients.call(pr.worker, "Worker.FetchPartition", &pr.args, &reply)
+		if !ok || (len(reply.Data) == 0 && pr.args.Offset < reply.Size) {
+			return 0, &fetchError{pr.args.MapTask, pr.worker}
+		}
+		if pr.size < 0 {
+			pr.stats.input(reply.Size)
+		}
+		pr.size = reply.Size
+		pr.args.Offset += int64(len(reply.Data))
+		pr.pending = reply.Data
+		if len(pr.pending) == 0 {
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, pr.pending)
+	pr.pending = pr.pending[n:]
+	return n, nil
+}
+
+// openRun opens the output that a map task wrote for a reduce task: from the
+// job's work directory, or from the worker that kept it if mapOutputs is set,
+// over clients.
+func openRun(workDir string, jobName string, mapTask int, reduceTask int, mapOutputs []MapOutput, clients *rpcClients, stats *taskStats) (io.ReadCloser, error) {
+	if mapOutputs != nil {
+		return io.NopCloser(newPartitionReader(jobName, mapTask, reduceTask, mapOutputs[mapTask], clients, stats)), nil
+	}
+	file, err := openInput(getIntermediateName(workDir, jobName, mapTask, reduceTask))
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	stats.input(info.Size())
+	return file, nil
+}
+
+// errMapOutputLost stops the reduce phase of a job that shuffles map output
+// between workers once the output of a map task is found to be gone, so that
+// the map task is run again before the reduce phase resumes.
+var errMapOutputLost = errors.New("map output lost")
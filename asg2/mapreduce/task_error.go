@@ -0,0 +1,212 @@
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// TaskErrorKind classifies why a task failed, so that the master can decide
+// whether running it again may help.
+type TaskErrorKind int
+
+const (
+	TaskIOError      TaskErrorKind = iota // reading or writing a file failed
+	TaskInputMissing                      // an input or intermediate file does not exist
+	TaskDiskFull                          // there was no space left to write the output
+	TaskPanic                             // a user-defined function panicked
+	TaskFetchFailed                       // map output could not be fetched from the worker holding it
+	TaskAbandoned                         // the task was abandoned because its job was cancelled or it timed out
+	TaskBadInput                          // a user-defined function rejected a record it was given
+)
+
+func (k TaskErrorKind) String() string {
+	switch k {
+	case TaskInputMissing:
+		return "input missing"
+	case TaskDiskFull:
+		return "disk full"
+	case TaskPanic:
+		return "panic"
+	case TaskFetchFailed:
+		return "fetch failed"
+	case TaskAbandoned:
+		return "abandoned"
+	case TaskBadInput:
+		return "bad input"
+	default:
+		return "I/O error"
+	}
+}
+
+// TaskError describes the failure of a task. Workers return it to the master
+// in the RunTask reply instead of exiting.
+type TaskError struct {
+	Kind   TaskErrorKind
+	Phase  jobPhase
+	Task   int
+	Err    string     // the underlying error or panic value
+	Record *BadRecord // the record a user function panicked on, if known
+	Lost   *int       // the map task whose output could not be fetched (TaskFetchFailed)
+}
+
+func (e *TaskError) Error() string {
+	if e.Record != nil {
+		return fmt.Sprintf("%v task %d: %v on %v: %s", e.Phase, e.Task, e.Kind, *e.Record, e.Err)
+	}
+	return fmt.Sprintf("%v task %d: %v: %s", e.Phase, e.Task, e.Kind, e.Err)
+}
+
+// BadRecord identifies the input of a user-defined function call that
+// panicked. The map function is called on a whole input range, named by its
+// file and offset, or on a record of a JobOutput file, named by its file and
+// key. Partitioners, combiners and reduce functions are called on a key.
+type BadRecord struct {
+	File   string
+	Offset int64
+	Key    string
+}
+
+func (r BadRecord) String() string {
+	switch {
+	case r.File == "":
+		return fmt.Sprintf("key %q", r.Key)
+	case r.Key != "":
+		return fmt.Sprintf("%s key %q", r.File, r.Key)
+	default:
+		return fmt.Sprintf("%s offset %d", r.File, r.Offset)
+	}
+}
+
+// skipSet indexes the records a task leaves out.
+func skipSet(skip []BadRecord) map[BadRecord]bool {
+	set := make(map[BadRecord]bool, len(skip))
+	for _, r := range skip {
+		set[r] = true
+	}
+	return set
+}
+
+// newTaskError wraps an error met by a task, classifying it by its cause.
+func newTaskError(phase jobPhase, task int, err error) *TaskError {
+	var te *TaskError
+	if errors.As(err, &te) {
+		return te
+	}
+	var fe *fetchError
+	if errors.As(err, &fe) {
+		lost := fe.mapTask
+		return &TaskError{Kind: TaskFetchFailed, Phase: phase, Task: task, Err: err.Error(), Lost: &lost}
+	}
+	var ie *inputError
+	kind := TaskIOError
+	switch {
+	case errors.Is(err, context.Canceled):
+		kind = TaskAbandoned
+	case errors.As(err, &ie) && errors.Is(ie.err, os.ErrNotExist):
+		kind = TaskInputMissing
+	case errors.Is(err, syscall.ENOSPC):
+		kind = TaskDiskFull
+	}
+	return &TaskError{Kind: kind, Phase: phase, Task: task, Err: err.Error()}
+}
+
+// inputError is an error met opening an input or intermediate file for
+// reading. Only such a file not existing makes a task's input missing; a file
+// the task writes vanishing under it is an ordinary I/O error.
+type inputError struct {
+	err error
+}
+
+func (e *inputError) Error() string {
+	return e.err.Error()
+}
+
+func (e *inputError) Unwrap() error {
+	return e.err
+}
+
+// openInput opens an input or intermediate file for reading.
+func openInput(name string) (*os.File, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, &inputError{err}
+	}
+	return file, nil
+}
+
+// rejectedRecord carries the error with which a user-defined function rejected
+// a record, such as the one returned by the TryMap function of a typed Job,
+// out of the untyped function that called it.
+type rejectedRecord struct {
+	err error
+}
+
+// protect calls a user-defined function on behalf of a task, turning a panic,
+// or a rejected record, into a TaskError. If f updates *record with the record
+// it is working on, the error names the record the failure happened on.
+func protect(phase jobPhase, task int, record *BadRecord, f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			te := &TaskError{Kind: TaskPanic, Phase: phase, Task: task, Err: fmt.Sprint(r)}
+			if rejected, ok := r.(rejectedRecord); ok {
+				te.Kind, te.Err = TaskBadInput, rejected.err.Error()
+			}
+			if *record != (BadRecord{}) {
+				bad := *record
+				te.Record = &bad
+			}
+			err = te
+		}
+	}()
+	f()
+	return nil
+}
+
+// How many times a task may fail with a TaskError before its job is failed.
+// Failures that lead to a bad record being skipped do not count, since the
+// re-execution without the record makes progress.
+const maxTaskFailures = 4
+
+// retryTask decides what the master does about a failed task that has now
+// failed the given number of times: run it again, preferably on another
+// worker, or give up and fail the job. An input file that is missing from the
+// shared file system will not appear by trying again.
+func retryTask(e *TaskError, failures int) bool {
+	if e.Kind == TaskInputMissing && e.Phase == mapPhase {
+		return false
+	}
+	return failures < maxTaskFailures
+}
+
+// noteBadRecord counts a failure on the record a TaskError names, if the job
+// skips bad records. It returns true if the record has now failed often
+// enough to be skipped by later executions of the task.
+func (j *job) noteBadRecord(e *TaskError) bool {
+	if j.config.SkipBadRecords <= 0 || e.Record == nil {
+		return false
+	}
+	id := taskID{e.Phase, e.Task}
+	if j.badRecords[id] == nil {
+		j.badRecords[id] = make(map[BadRecord]int)
+	}
+	j.badRecords[id][*e.Record]++
+	if j.badRecords[id][*e.Record] != j.config.SkipBadRecords {
+		return false
+	}
+	debug("Job %s: skipping bad record %v of %v task %d\n", j.jobName, *e.Record, e.Phase, e.Task)
+	return true
+}
+
+// skipList returns the records that executions of a task must leave out.
+func (j *job) skipList(phase jobPhase, task int) []BadRecord {
+	var skip []BadRecord
+	for r, n := range j.badRecords[taskID{phase, task}] {
+		if n >= j.config.SkipBadRecords {
+			skip = append(skip, r)
+		}
+	}
+	return skip
+}
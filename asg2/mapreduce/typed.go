@@ -0,0 +1,299 @@
+package mapreduce
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Serde converts the keys, values or results of a typed Job to and from the
+// strings that map and reduce tasks pass around.
+type Serde[T any] interface {
+	Encode(v T) string
+	Decode(s string) (T, error)
+}
+
+// DefaultSerde returns the Serde a Job uses when it is not given one: strings
+// are passed on as they are, integers, floats and booleans are formatted with
+// strconv, and anything else is encoded as JSON.
+func DefaultSerde[T any]() Serde[T] {
+	var zero T
+	switch any(zero).(type) {
+	case string:
+		return stringSerde[T]{}
+	case int, int64, float64, bool:
+		return strconvSerde[T]{}
+	default:
+		return jsonSerde[T]{}
+	}
+}
+
+type stringSerde[T any] struct{}
+
+func (stringSerde[T]) Encode(v T) string { return any(v).(string) }
+
+func (stringSerde[T]) Decode(s string) (T, error) { return any(s).(T), nil }
+
+type strconvSerde[T any] struct{}
+
+func (strconvSerde[T]) Encode(v T) string {
+	switch v := any(v).(type) {
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		return strconv.FormatBool(v.(bool))
+	}
+}
+
+func (strconvSerde[T]) Decode(s string) (T, error) {
+	var v T
+	var decoded any
+	var err error
+	switch any(v).(type) {
+	case int:
+		decoded, err = strconv.Atoi(s)
+	case int64:
+		decoded, err = strconv.ParseInt(s, 10, 64)
+	case float64:
+		decoded, err = strconv.ParseFloat(s, 64)
+	default:
+		decoded, err = strconv.ParseBool(s)
+	}
+	if err != nil {
+		return v, err
+	}
+	return decoded.(T), nil
+}
+
+type jsonSerde[T any] struct{}
+
+func (jsonSerde[T]) Encode(v T) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+func (jsonSerde[T]) Decode(s string) (T, error) {
+	var v T
+	err := json.Unmarshal([]byte(s), &v)
+	return v, err
+}
+
+// Pair is a key/value pair emitted by the map function of a typed Job.
+type Pair[K any, V any] struct {
+	Key   K
+	Value V
+}
+
+// Iterator hands the reduce (or combine) function of a typed Job the values of
+// a key one at a time, and adds to the job's counters.
+type Iterator[V any] interface {
+	Next() (value V, ok bool)
+	Reporter
+}
+
+// typedIterator decodes the values of a ValueIterator. A value that cannot be
+// decoded panics, failing the task as a panic in the reduce function would.
+type typedIterator[V any] struct {
+	values ValueIterator
+	serde  Serde[V]
+}
+
+func (it typedIterator[V]) Next() (V, bool) {
+	s, ok := it.values.Next()
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	v, err := it.serde.Decode(s)
+	if err != nil {
+		panic(fmt.Sprintf("cannot decode value %q: %v", s, err))
+	}
+	return v, true
+}
+
+func (it typedIterator[V]) AddCounter(name string, delta int64) { it.values.AddCounter(name, delta) }
+
+// Job describes a MapReduce job whose map function emits keys of type K with
+// values of type V, and whose reduce function turns the values of a key into
+// a result of type R. It runs on top of Sequential, Distributed and RunWorker,
+// encoding keys, values and results with its Serdes.
+type Job[K comparable, V any, R any] struct {
+	Name   string
+	Config JobConfig
+	Map    func(file string, contents string, r Reporter) []Pair[K, V]
+	Reduce func(key K, values Iterator[V]) R
+
+	// TryMap, if set, is used instead of Map by a job whose input may hold
+	// records it cannot use. The error it returns fails the map task with a
+	// TaskBadInput TaskError naming the record, which SkipBadRecords skips
+	// as it does one a function panicked on.
+	TryMap func(file string, contents string, r Reporter) ([]Pair[K, V], error)
+
+	Combine func(key K, values Iterator[V]) V // optional, may be nil
+
+	// Less orders the keys seen by reduce functions and written to the
+	// merged output; nil orders them by their encoding. It replaces
+	// Config.Options.KeyOrder.
+	Less func(a, b K) bool
+
+	// SameGroup, if set, has reduce functions called once per group of
+	// consecutive keys, in key order, with the values of all of them; the
+	// key they are given, and their result is written under, is the
+	// group's first. It replaces Config.Options.Grouping.
+	SameGroup func(a, b K) bool
+
+	Keys    Serde[K] // nil means DefaultSerde[K]()
+	Values  Serde[V] // nil means DefaultSerde[V]()
+	Results Serde[R] // nil means DefaultSerde[R]()
+
+	register sync.Once // registers the key order and grouping, once
+}
+
+// Sequential runs the job with Sequential, until ctx is done.
+func (j *Job[K, V, R]) Sequential(ctx context.Context) *Master {
+	mapF, reduceF, combineF := j.functions()
+	return Sequential(ctx, j.Name, j.config(), mapF, reduceF, combineF)
+}
+
+// Distributed runs the job with Distributed, until ctx is done, on workers
+// started with the job's RunWorker.
+func (j *Job[K, V, R]) Distributed(ctx context.Context, master string) *Master {
+	return Distributed(ctx, j.Name, j.config(), master)
+}
+
+// RunWorker runs a worker for the job with RunWorker.
+func (j *Job[K, V, R]) RunWorker(master string, me string, local []string, slots int, nRPC int, shutdownOnSignal bool) {
+	j.config() // registers the key order and grouping the tasks use
+	mapF, reduceF, combineF := j.functions()
+	RunWorker(master, me, mapF, reduceF, combineF, local, slots, nRPC, shutdownOnSignal)
+}
+
+// Stage returns the job as a stage of SequentialPipeline or DistributedPipeline.
+func (j *Job[K, V, R]) Stage() Stage {
+	mapF, reduceF, combineF := j.functions()
+	return Stage{Name: j.Name, Map: mapF, Reduce: reduceF, Combine: combineF, Config: j.config()}
+}
+
+// Output returns the input format with which another job reads the reducer
+// output of this one once it has completed.
+func (j *Job[K, V, R]) Output() JobOutput {
+	return j.Stage().output()
+}
+
+// config returns the configuration of the untyped job, which combines map
+// output if the job has a Combine function. The key order of a job with a Less
+// function, and the key grouping of one with a SameGroup function, are
+// registered under a name derived from the job's the first time it is called,
+// so the workers of a job started in one process do not register them again
+// while each other's tasks run.
+func (j *Job[K, V, R]) config() JobConfig {
+	config := j.Config
+	config.Options.Combine = j.Combine != nil
+	if j.SameGroup != nil {
+		config.Options.Grouping = "typed:" + j.Name
+	}
+	if j.Less != nil {
+		config.Options.KeyOrder = "typed:" + j.Name
+	}
+	j.register.Do(func() { j.registerKeyOrder(config.Options) })
+	return config
+}
+
+// registerKeyOrder registers the job's key order and grouping under the names
+// its options give them.
+func (j *Job[K, V, R]) registerKeyOrder(options JobOptions) {
+	keys := j.keys()
+	if j.SameGroup != nil {
+		RegisterKeyGrouping(options.Grouping, func(a, b string) bool {
+			ka, errA := keys.Decode(a)
+			kb, errB := keys.Decode(b)
+			if errA != nil || errB != nil {
+				return a == b
+			}
+			return j.SameGroup(ka, kb)
+		}, nil)
+	}
+	if j.Less != nil {
+		RegisterKeyOrder(options.KeyOrder, func(a, b string) bool {
+			ka, errA := keys.Decode(a)
+			kb, errB := keys.Decode(b)
+			if errA != nil || errB != nil {
+				return a < b
+			}
+			return j.Less(ka, kb)
+		})
+	}
+}
+
+// functions wraps the job's functions into the untyped ones of the worker.
+func (j *Job[K, V, R]) functions() (
+	mapF func(string, string, Reporter) []KeyValue,
+	reduceF func(string, ValueIterator) string,
+	combineF func(string, ValueIterator) string,
+) {
+	keys, values, results := j.keys(), j.values(), j.results()
+	decodeKey := func(s string) K {
+		k, err := keys.Decode(s)
+		if err != nil {
+			panic(fmt.Sprintf("cannot decode key %q: %v", s, err))
+		}
+		return k
+	}
+
+	mapF = func(file string, contents string, r Reporter) []KeyValue {
+		var pairs []Pair[K, V]
+		if j.TryMap != nil {
+			var err error
+			pairs, err = j.TryMap(file, contents, r)
+			if err != nil {
+				panic(rejectedRecord{err})
+			}
+		} else {
+			pairs = j.Map(file, contents, r)
+		}
+		keyvals := make([]KeyValue, 0, len(pairs))
+		for _, p := range pairs {
+			keyvals = append(keyvals, KeyValue{Key: keys.Encode(p.Key), Value: values.Encode(p.Value)})
+		}
+		return keyvals
+	}
+	reduceF = func(key string, vs ValueIterator) string {
+		return results.Encode(j.Reduce(decodeKey(key), typedIterator[V]{vs, values}))
+	}
+	if j.Combine != nil {
+		combineF = func(key string, vs ValueIterator) string {
+			return values.Encode(j.Combine(decodeKey(key), typedIterator[V]{vs, values}))
+		}
+	}
+	return mapF, reduceF, combineF
+}
+
+func (j *Job[K, V, R]) keys() Serde[K] {
+	if j.Keys != nil {
+		return j.Keys
+	}
+	return DefaultSerde[K]()
+}
+
+func (j *Job[K, V, R]) values() Serde[V] {
+	if j.Values != nil {
+		return j.Values
+	}
+	return DefaultSerde[V]()
+}
+
+func (j *Job[K, V, R]) results() Serde[R] {
+	if j.Results != nil {
+		return j.Results
+	}
+	return DefaultSerde[R]()
+}
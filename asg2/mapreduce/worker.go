@@ -1,6 +1,11 @@
 package mapreduce
 
 import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/rpc"
@@ -13,43 +18,163 @@ import (
 type Worker struct {
 	sync.Mutex
 
-	name   string
-	Map    func(string, string) []KeyValue
-	Reduce func(string, []string) string
-	nRPC   int // protected by mutex
-	nTasks int // protected by mutex
-	l      net.Listener
+	name       string
+	Map        func(string, string, Reporter) []KeyValue
+	Reduce     func(string, ValueIterator) string
+	Combine    func(string, ValueIterator) string   // optional, may be nil
+	stages     map[string]Stage                     // the functions of each job of a pipeline, nil to use the above
+	local      []string                             // directories or hosts advertised to the master
+	shuffleDir string                               // map output kept for FetchPartition, protected by mutex
+	nRPC       int                                  // RPCs the worker still serves, -1 for no limit, protected by mutex
+	nTasks     int                                  // tasks run, protected by mutex
+	clients    *rpcClients                          // connections to the master and the other workers
+	running    map[*TaskProgress]*taskStats         // attempts in progress, protected by mutex
+	abandon    map[*TaskProgress]context.CancelFunc // abandons the attempts in progress, protected by mutex
+	nSlots     int                                  // tasks run at once, advertised to the master
+	freeSlots  chan int                             // indices of the slots not running a task
+	slotStats  []SlotStats                          // protected by mutex
+	l          net.Listener
+	serving    sync.WaitGroup // RPCs read but not yet replied to
 
 	shutdownChan     chan int
 	shutdownOnSignal bool
+
+	stopHeartbeat chan struct{} // closed by stop
+	stopOnce      sync.Once
 }
 
 // RunTask is called by the master when a new task is being scheduled on this
-// worker.
-func (wk *Worker) RunTask(arg *RunTaskArgs, _ *struct{}) error {
-	debug("%s: given %v task #%d on file %s (numOtherPhase: %d)\n",
-		wk.name, arg.Phase, arg.TaskNumber, arg.File, arg.NumOtherPhase)
+// worker. A task that fails is reported in the reply, leaving it to the master
+// to decide what to do about it. The work the task did is reported either way,
+// and its progress is sent with the worker's heartbeats while it runs.
+func (wk *Worker) RunTask(arg *RunTaskArgs, reply *RunTaskReply) error {
+	debug("%s: given %v task #%d on %d file ranges (numOtherPhase: %d)\n",
+		wk.name, arg.Phase, arg.TaskNumber, len(arg.Split.Ranges), arg.NumOtherPhase)
+
+	slot := wk.acquireSlot()
+	defer wk.releaseSlot(slot, time.Now())
+	wk.Lock()
+	wk.nTasks++
+	wk.Unlock()
 
+	stats := newTaskStats()
+	ctx, abandon := context.WithCancel(context.Background())
+	defer abandon()
+	progress := &TaskProgress{
+		JobName: arg.JobName,
+		Phase:   arg.Phase,
+		Task:    arg.TaskNumber,
+		Attempt: arg.Attempt,
+		Worker:  wk.name,
+	}
+	wk.Lock()
+	if wk.running == nil {
+		wk.running = make(map[*TaskProgress]*taskStats)
+		wk.abandon = make(map[*TaskProgress]context.CancelFunc)
+	}
+	wk.running[progress] = stats
+	wk.abandon[progress] = abandon
+	wk.Unlock()
+	defer func() {
+		wk.Lock()
+		delete(wk.running, progress)
+		delete(wk.abandon, progress)
+		wk.Unlock()
+		reply.Stats = stats.snapshot()
+	}()
+
+	mapF, reduceF, combineF := wk.Map, wk.Reduce, wk.Combine
+	if wk.stages != nil {
+		s, ok := wk.stages[arg.JobName]
+		if !ok {
+			reply.Err = newTaskError(arg.Phase, arg.TaskNumber, fmt.Errorf("no stage named %s", arg.JobName))
+			return nil
+		}
+		mapF, reduceF, combineF = s.Map, s.Reduce, s.Combine
+	}
+	var err error
+	workDir := arg.WorkDir
 	switch arg.Phase {
 	case mapPhase:
-		runMapTask(arg.JobName, arg.TaskNumber, arg.File, arg.NumOtherPhase, wk.Map)
+		if !arg.Options.Combine {
+			combineF = nil
+		}
+		if arg.Options.LocalShuffle {
+			workDir, err = wk.shuffleWorkDir(arg.JobName)
+			if err != nil {
+				break
+			}
+		}
+		err = runMapTask(ctx, arg.JobName, workDir, arg.TaskNumber, arg.Attempt, arg.Split, arg.NumOtherPhase, mapF, combineF, arg.Skip, arg.Options, stats)
 	case reducePhase:
-		runReduceTask(arg.JobName, arg.TaskNumber, arg.NumOtherPhase, wk.Reduce)
+		err = runReduceTask(ctx, arg.JobName, arg.WorkDir, arg.TaskNumber, arg.Attempt, arg.NumOtherPhase, reduceF, arg.Skip, arg.Options, arg.MapOutputs, wk.clients, stats)
+	}
+	if err != nil && ctx.Err() != nil {
+		debug("%s: %v task #%d abandoned\n", wk.name, arg.Phase, arg.TaskNumber)
+		removeAttempt(workDir, arg)
+	}
+	if err != nil {
+		debug("%s: %v task #%d failed: %v\n", wk.name, arg.Phase, arg.TaskNumber, err)
+		reply.Err = newTaskError(arg.Phase, arg.TaskNumber, err)
+		return nil
 	}
 
 	debug("%s: %v task #%d done\n", wk.name, arg.Phase, arg.TaskNumber)
 	return nil
 }
 
+// Abandon is called by the master when a job is cancelled. The worker's
+// attempts at the job's tasks stop at the next record and remove the output
+// they have written, and RunTask returns for them.
+func (wk *Worker) Abandon(args *JobArgs, _ *struct{}) error {
+	wk.Lock()
+	defer wk.Unlock()
+	for p, abandon := range wk.abandon {
+		if p.JobName == args.JobName {
+			abandon()
+		}
+	}
+	return nil
+}
+
+// AbandonAttempt is called by the master when an attempt at a task has run for
+// too long. The attempt stops at the next record and removes the output it has
+// written, as with Abandon.
+func (wk *Worker) AbandonAttempt(args *AttemptArgs, _ *struct{}) error {
+	wk.Lock()
+	defer wk.Unlock()
+	for p, abandon := range wk.abandon {
+		if p.JobName == args.JobName && p.Phase == args.Phase && p.Task == args.Task && p.Attempt == args.Attempt {
+			abandon()
+		}
+	}
+	return nil
+}
+
+// removeAttempt removes the output an abandoned attempt has written to
+// workDir.
+func removeAttempt(workDir string, arg *RunTaskArgs) {
+	if arg.Phase == reducePhase {
+		os.Remove(getAttemptName(getReduceOutName(workDir, arg.JobName, arg.TaskNumber), arg.Attempt))
+		return
+	}
+	for i := 0; i < arg.NumOtherPhase; i++ {
+		os.Remove(getAttemptName(getIntermediateName(workDir, arg.JobName, arg.TaskNumber, i), arg.Attempt))
+	}
+}
+
 // Shutdown is called by the master when all work has been completed.
-// We should respond with the number of tasks we have processed.
+// We should respond with the number of tasks we have processed, and what each
+// slot did.
 func (wk *Worker) Shutdown(_ *struct{}, res *ShutdownReply) error {
 	debug("Shutdown %s\n", wk.name)
 	wk.Lock()
 	defer wk.Unlock()
 	res.Ntasks = wk.nTasks
-	wk.nRPC = 1
-	wk.nTasks-- // Don't count the shutdown RPC
+	res.Slots = append([]SlotStats(nil), wk.slotStats...)
+	wk.nRPC = 0 // serve no RPC after this one
+	wk.l.Close()
+	wk.stop()
 	if wk.shutdownOnSignal {
 		wk.shutdownChan <- 1
 	}
@@ -57,41 +182,228 @@ func (wk *Worker) Shutdown(_ *struct{}, res *ShutdownReply) error {
 }
 
 // Tell the master we exist and ready to work
-func (wk *Worker) register(master string) {
+func (wk *Worker) register(master string) error {
 	args := new(RegisterArgs)
 	args.Worker = wk.name
-	ok := call(master, "Master.Register", args, new(struct{}))
+	args.Local = wk.local
+	args.Slots = wk.nSlots
+	ok := wk.clients.call(master, "Master.Register", args, new(struct{}))
 	if !ok {
-		log.Fatalf("Register: RPC %s register error\n", master)
+		return fmt.Errorf("Register: RPC %s register error", master)
+	}
+	return nil
+}
+
+// heartbeat reports to the master every heartbeatInterval that this worker is
+// alive, until the worker stops. If the master has forgotten about the worker,
+// or declared it dead, it registers again; if that fails, the next heartbeat
+// tries again.
+func (wk *Worker) heartbeat(master string) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-wk.stopHeartbeat:
+			return
+		case <-ticker.C:
+			var reply HeartbeatReply
+			args := &HeartbeatArgs{Worker: wk.name, Tasks: wk.progress()}
+			ok := wk.clients.call(master, "Master.Heartbeat", args, &reply)
+			if ok && !reply.Registered {
+				debug("%s: unknown to master %s, registering again\n", wk.name, master)
+				if err := wk.register(master); err != nil {
+					debug("%s: %v\n", wk.name, err)
+				}
+			}
+		}
+	}
+}
+
+// initSlots sets up the worker's slots, one unless it was given more.
+func (wk *Worker) initSlots() {
+	if wk.nSlots < 1 {
+		wk.nSlots = 1
+	}
+	wk.freeSlots = make(chan int, wk.nSlots)
+	wk.slotStats = make([]SlotStats, wk.nSlots)
+	for i := 0; i < wk.nSlots; i++ {
+		wk.freeSlots <- i
 	}
 }
 
+// acquireSlot takes a free slot to run a task in, waiting for one if need be.
+func (wk *Worker) acquireSlot() int {
+	wk.Lock()
+	if wk.freeSlots == nil {
+		wk.initSlots()
+	}
+	free := wk.freeSlots
+	wk.Unlock()
+	return <-free
+}
+
+// releaseSlot records that a slot has finished a task started at the given
+// time.
+func (wk *Worker) releaseSlot(slot int, started time.Time) {
+	wk.Lock()
+	wk.slotStats[slot].Tasks++
+	wk.slotStats[slot].Busy += time.Since(started)
+	wk.Unlock()
+	wk.freeSlots <- slot
+}
+
+// progress reports how far the worker's running attempts have got.
+func (wk *Worker) progress() []TaskProgress {
+	wk.Lock()
+	defer wk.Unlock()
+	tasks := make([]TaskProgress, 0, len(wk.running))
+	for p, stats := range wk.running {
+		progress := *p
+		progress.Stats = stats.snapshot()
+		tasks = append(tasks, progress)
+	}
+	return tasks
+}
+
+// stop ends the heartbeats of the worker and closes its connections. The map
+// output it kept is removed by RunWorker once its tasks have ended.
+func (wk *Worker) stop() {
+	wk.stopOnce.Do(func() {
+		close(wk.stopHeartbeat)
+		wk.clients.close()
+	})
+}
+
+// workerCodec is the gob codec net/rpc serves connections with, which also
+// counts the RPCs a worker serves against its limit. Once the limit is reached
+// the worker stops listening, and the RPCs that arrive after that are dropped
+// along with their connection, as if the worker had failed. The RPCs it reads
+// are counted in the worker's serving group until they are replied to.
+type workerCodec struct {
+	wk     *Worker
+	conn   io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+}
+
+func newWorkerCodec(wk *Worker, conn io.ReadWriteCloser) *workerCodec {
+	buf := bufio.NewWriter(conn)
+	return &workerCodec{wk: wk, conn: conn, dec: gob.NewDecoder(conn), enc: gob.NewEncoder(buf), encBuf: buf}
+}
+
+func (c *workerCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := c.dec.Decode(r)
+	if err != nil {
+		return err
+	}
+	c.wk.Lock()
+	defer c.wk.Unlock()
+	if c.wk.nRPC == 0 {
+		return io.EOF
+	}
+	// Counted before the listener is closed, so that RunWorker waits for it.
+	c.wk.serving.Add(1)
+	if c.wk.nRPC > 0 {
+		c.wk.nRPC--
+		if c.wk.nRPC == 0 {
+			c.wk.l.Close()
+		}
+	}
+	return nil
+}
+
+func (c *workerCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *workerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	defer c.wk.serving.Done()
+	err := c.enc.Encode(r)
+	if err == nil {
+		err = c.enc.Encode(body)
+	}
+	if err == nil {
+		err = c.encBuf.Flush()
+	}
+	if err != nil {
+		c.Close()
+	}
+	return err
+}
+
+func (c *workerCodec) Close() error {
+	return c.conn.Close()
+}
+
 // RunWorker sets up a connection with the master, registers its address, and
-// waits for tasks to be scheduled.
+// waits for tasks to be scheduled. Both addresses are either unix socket paths
+// or URLs of the form unix:///path or tcp://host:port.
 func RunWorker(MasterAddress string, me string,
-	MapFunc func(string, string) []KeyValue,
-	ReduceFunc func(string, []string) string,
+	MapFunc func(string, string, Reporter) []KeyValue,
+	ReduceFunc func(string, ValueIterator) string,
+	CombineFunc func(string, ValueIterator) string, // Optional combiner applied to map output (nil means none)
+	local []string, // Directories or hosts whose input this worker reads locally (nil means none)
+	slots int, // Number of tasks the worker runs at once (less than 1 means 1)
 	nRPC int, // Limit on RPC calls that can be invoked on the worker (-1 means no limit)
 	shutdownOnSignal bool, // Should be True when running worker as an independent process
 ) {
-	debug("RunWorker %s\n", me)
-	wk := new(Worker)
-	wk.name = me
+	wk := newWorker(me, local, slots, nRPC, shutdownOnSignal)
 	wk.Map = MapFunc
 	wk.Reduce = ReduceFunc
+	wk.Combine = CombineFunc
+	wk.serve(MasterAddress, me)
+}
+
+// RunPipelineWorker runs a worker, as RunWorker does, for the stages of a
+// pipeline started by DistributedPipeline. Every task runs the functions of
+// the stage it belongs to.
+func RunPipelineWorker(MasterAddress string, me string, stages []Stage,
+	local []string, slots int, nRPC int, shutdownOnSignal bool) {
+	wk := newWorker(me, local, slots, nRPC, shutdownOnSignal)
+	wk.stages = make(map[string]Stage)
+	for _, s := range stages {
+		wk.stages[s.Name] = s
+	}
+	wk.serve(MasterAddress, me)
+}
+
+func newWorker(me string, local []string, slots int, nRPC int, shutdownOnSignal bool) *Worker {
+	wk := new(Worker)
+	wk.name = me
+	wk.local = local
+	wk.nSlots = slots
+	wk.initSlots()
 	wk.nRPC = nRPC
+	wk.clients = newRPCClients()
 	wk.shutdownOnSignal = shutdownOnSignal
+	return wk
+}
+
+// serve registers the worker with the master and serves its RPCs until it is
+// shut down or reaches its RPC limit.
+func (wk *Worker) serve(MasterAddress string, me string) {
+	debug("RunWorker %s\n", me)
 	rpcs := rpc.NewServer()
 	rpcs.Register(wk)
-	os.Remove(me) // only needed for "unix"
-	l, e := net.Listen("unix", me)
+	e := checkWorkerAddress(me)
+	if e != nil {
+		log.Fatal("RunWorker: ", e)
+	}
+	l, address, e := listen(me)
 	if e != nil {
 		log.Fatal("RunWorker: worker ", me, " error: ", e)
 	}
 	wk.l = l
-	wk.register(MasterAddress)
+	wk.name = address                      // what the master dials, e.g. with the port filled in
+	wk.stopHeartbeat = make(chan struct{}) // before the master can call the worker
+	e = wk.register(MasterAddress)
+	if e != nil {
+		log.Fatal("RunWorker: worker ", me, " error: ", e)
+	}
+	go wk.heartbeat(MasterAddress)
 
-	if shutdownOnSignal {
+	if wk.shutdownOnSignal {
 		wk.shutdownChan = make(chan int)
 		go func() { // This thread is added to shut down the worker process after receiving a shutdown signal
 			sig := <-wk.shutdownChan
@@ -102,27 +414,20 @@ func RunWorker(MasterAddress string, me string,
 		}()
 	}
 
-	// DON'T MODIFY CODE BELOW
+	// The master and the other workers keep their connections open, so the
+	// RPC limit is counted per call rather than per connection.
 	for {
-		wk.Lock()
-		if wk.nRPC == 0 {
-			wk.Unlock()
-			break
-		}
-		wk.Unlock()
 		conn, err := wk.l.Accept()
-		if err == nil {
-			wk.Lock()
-			wk.nRPC--
-			wk.Unlock()
-			go rpcs.ServeConn(conn)
-			wk.Lock()
-			wk.nTasks++
-			wk.Unlock()
-		} else {
+		if err != nil {
 			break
 		}
+		go rpcs.ServeCodec(newWorkerCodec(wk, conn))
 	}
 	wk.l.Close()
+	// The RPC that reached the limit may still be running a task, which
+	// writes to the shuffle directory.
+	wk.serving.Wait()
+	wk.stop()
+	wk.removeShuffleDir()
 	debug("RunWorker %s exit\n", me)
 }